@@ -10,43 +10,132 @@ import (
 )
 
 var arguments struct {
-	Threads     int
-	S3AccessKey string
-	S3SecretKey string
-	S3CredsFile string
-	Config      string
-	Debug       bool
+	Command         string
+	Threads         int
+	MaxUploads      int
+	BandwidthLimit  string
+	ShutdownTimeout int
+	S3AccessKey     string
+	S3SecretKey     string
+	S3CredsFile     string
+	Config          string
+	Job             string
+	Debug           bool
+	DryRun          bool
+	WatchConfig     bool
+	Listen          string
+	StatusListen    string
+	Files           []string
+	Output          string
+	Format          string
+	XferDir         string
 }
 
 func argumentParsing(args []string) {
 	// Create new parser object
 	parser := argparse.NewParser("warchangel", "upload WARC files to the Internet Archive")
 
-	threads := parser.Int("t", "threads", &argparse.Options{
+	config := parser.String("c", "config", &argparse.Options{
+		Required: true,
+		Default:  "",
+		Help:     "Configuration file (can either be a legacy YAML draintasker configuration file or a warchangel JSON or YAML configuration), run also accepts a directory of configurations or a file listing several jobs"})
+
+	job := parser.String("j", "job", &argparse.Options{
+		Required: false,
+		Help:     "Only work on this job when the configuration lists several jobs (all commands but run and migrate-config)"})
+
+	debug := parser.Flag("d", "debug", &argparse.Options{
+		Required: false,
+		Help:     "Enable debug mode"})
+
+	// run
+	runCmd := parser.NewCommand("run", "Watch the WARCs directory and upload WARC files as they are written")
+
+	threads := runCmd.Int("t", "threads", &argparse.Options{
 		Required: false,
-		Default:  4,
-		Help:     "Number of parallel uploads"})
+		Help:     "Number of parallel uploads per job, overrides the configurations' threads (defaults to 4)"})
 
-	S3AccessKey := parser.String("", "s3-access-key", &argparse.Options{
+	maxUploads := runCmd.Int("", "max-uploads", &argparse.Options{
+		Required: false,
+		Help:     "Number of parallel uploads shared by all the jobs, 0 means no limit besides each job's threads"})
+
+	bwLimit := runCmd.String("", "bwlimit", &argparse.Options{
+		Required: false,
+		Help:     "Bandwidth shared by all the jobs, in bytes per second such as 20M or as a timetable such as \"Mon-08:00,20M Mon-19:00,off\". No limit by default"})
+
+	S3AccessKey := runCmd.String("", "s3-access-key", &argparse.Options{
 		Required: false,
 		Help:     "S3 access key"})
 
-	S3SecretKey := parser.String("", "s3-secret-key", &argparse.Options{
+	S3SecretKey := runCmd.String("", "s3-secret-key", &argparse.Options{
 		Required: false,
 		Help:     "S3 secret key"})
 
-	S3CredsFile := parser.String("", "s3-creds-file", &argparse.Options{
+	S3CredsFile := runCmd.String("", "s3-creds-file", &argparse.Options{
 		Required: false,
-		Help:     "S3 credentials file"})
+		Help:     "S3 credentials file (defaults to $HOME/.ias3cfg)"})
 
-	config := parser.String("c", "config", &argparse.Options{
-		Required: true,
-		Default:  "",
-		Help:     "Configuration file (can either be a legacy YAML draintasker configuration file or a warchangel JSON configuration)"})
+	dryRun := runCmd.Flag("", "dry-run", &argparse.Options{
+		Required: false,
+		Help:     "Run a single pass of the pipeline and report what would be uploaded, without uploading anything"})
 
-	debug := parser.Flag("d", "debug", &argparse.Options{
+	shutdownTimeout := runCmd.Int("", "shutdown-timeout", &argparse.Options{
 		Required: false,
-		Help:     "Enable debug mode"})
+		Help:     "Seconds to wait for the uploads in progress when shutting down before aborting them, 0 means waiting for them to finish. A second signal aborts them right away"})
+
+	watchConfig := runCmd.Flag("", "watch-config", &argparse.Options{
+		Required: false,
+		Help:     "Reload the configuration when the configuration file changes, in addition to SIGHUP"})
+
+	listen := runCmd.String("", "listen", &argparse.Options{
+		Required: false,
+		Help:     "Address of the push API where crawlers submit finished WARC files, host:port or unix:/path/to/socket. It has no authentication, prefer a unix socket. Disabled by default"})
+
+	statusListen := runCmd.String("", "status-listen", &argparse.Options{
+		Required: false,
+		Help:     "Address of the Prometheus metrics, of the status and of the health probes, host:port or unix:/path/to/socket. Disabled by default"})
+
+	// plan
+	planCmd := parser.NewCommand("plan", "Show how the WARC files waiting to be uploaded would be grouped into items")
+
+	// status
+	statusCmd := parser.NewCommand("status", "Show the state of the job's files and items")
+
+	// verify
+	verifyCmd := parser.NewCommand("verify", "Compare uploaded WARC files with their copy on archive.org")
+
+	verifyFiles := verifyCmd.StringList("f", "file", &argparse.Options{
+		Required: false,
+		Help:     "File to verify, can be repeated (defaults to every uploaded file)"})
+
+	// retry
+	retryCmd := parser.NewCommand("retry", "Requeue failed WARC files so that they are uploaded again")
+
+	retryFiles := retryCmd.StringList("f", "file", &argparse.Options{
+		Required: false,
+		Help:     "Failed file to requeue, can be repeated (defaults to every failed file)"})
+
+	// migrate-config
+	migrateCmd := parser.NewCommand("migrate-config", "Convert a legacy Draintasker YAML configuration into a warchangel configuration")
+
+	output := migrateCmd.String("o", "output", &argparse.Options{
+		Required: false,
+		Help:     "Where to write the warchangel configuration (defaults to stdout)"})
+
+	format := migrateCmd.Selector("f", "format", []string{"json", "yaml"}, &argparse.Options{
+		Required: false,
+		Default:  "json",
+		Help:     "Format of the warchangel configuration"})
+
+	// validate-config
+	validateCmd := parser.NewCommand("validate-config", "Validate the configuration and show it with its defaults applied")
+
+	// import-draintasker
+	importCmd := parser.NewCommand("import-draintasker", "Import the state of Draintasker pack directories so that a job can be switched over to warchangel")
+
+	xferDir := importCmd.String("x", "xfer-dir", &argparse.Options{
+		Required: true,
+		Help:     "Draintasker transfer directory (xfer_dir) holding the pack directories"})
 
 	// Parse input
 	err := parser.Parse(args)
@@ -58,17 +147,51 @@ func argumentParsing(args []string) {
 	}
 
 	// Finally save the collected flags
-	arguments.Threads = *threads
-	arguments.S3AccessKey = *S3AccessKey
-	arguments.S3SecretKey = *S3SecretKey
-	arguments.S3CredsFile = *S3CredsFile
 	arguments.Config = *config
 	arguments.Debug = *debug
+	arguments.Job = *job
+
+	switch {
+	case runCmd.Happened():
+		arguments.Command = "run"
+		arguments.Threads = *threads
+		arguments.MaxUploads = *maxUploads
+		arguments.BandwidthLimit = *bwLimit
+		arguments.ShutdownTimeout = *shutdownTimeout
+		arguments.S3AccessKey = *S3AccessKey
+		arguments.S3SecretKey = *S3SecretKey
+		arguments.S3CredsFile = *S3CredsFile
+		arguments.DryRun = *dryRun
+		arguments.WatchConfig = *watchConfig
+		arguments.Listen = *listen
+		arguments.StatusListen = *statusListen
+	case planCmd.Happened():
+		arguments.Command = "plan"
+	case statusCmd.Happened():
+		arguments.Command = "status"
+	case verifyCmd.Happened():
+		arguments.Command = "verify"
+		arguments.Files = *verifyFiles
+	case retryCmd.Happened():
+		arguments.Command = "retry"
+		arguments.Files = *retryFiles
+	case migrateCmd.Happened():
+		arguments.Command = "migrate-config"
+		arguments.Output = *output
+		arguments.Format = *format
+	case validateCmd.Happened():
+		arguments.Command = "validate-config"
+	case importCmd.Happened():
+		arguments.Command = "import-draintasker"
+		arguments.XferDir = *xferDir
+	}
 
-	// Load S3 credentials from file if specified
-	if arguments.S3AccessKey == "" || arguments.S3SecretKey == "" {
-		// Get the .ias3cfg in the $HOME directory
-		arguments.S3CredsFile = os.ExpandEnv("$HOME/.ias3cfg")
+	// Load S3 credentials from file if they are needed and not specified
+	if arguments.Command == "run" && !arguments.DryRun && (arguments.S3AccessKey == "" || arguments.S3SecretKey == "") {
+		// Default to the .ias3cfg in the $HOME directory
+		if arguments.S3CredsFile == "" {
+			arguments.S3CredsFile = os.ExpandEnv("$HOME/.ias3cfg")
+		}
 
 		arguments.S3AccessKey, arguments.S3SecretKey, err = loadS3CredsFromFile(arguments.S3CredsFile)
 		if err != nil {
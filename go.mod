@@ -2,7 +2,15 @@ module github.com/internetarchive/warchangel
 
 go 1.23.3
 
-require github.com/akamensky/argparse v1.4.0
+require (
+	github.com/akamensky/argparse v1.4.0
+	github.com/klauspost/compress v1.17.9
+	github.com/prometheus/client_golang v1.19.1
+	github.com/rclone/rclone v1.68.2
+	golang.org/x/sys v0.22.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
 	github.com/abbot/go-http-auth v0.4.0 // indirect
@@ -19,12 +27,9 @@ require (
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/ncw/swift/v2 v2.0.3 // indirect
 	github.com/power-devops/perfstat v0.0.0-20221212215047-62379fc7944b // indirect
-	github.com/prometheus/client_golang v1.19.1 // indirect
 	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.48.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
-	github.com/rclone/rclone v1.68.2 // indirect
-	github.com/remeh/sizedwaitgroup v1.0.0 // indirect
 	github.com/shirou/gopsutil/v3 v3.24.5 // indirect
 	github.com/shoenig/go-m1cpu v0.1.6 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
@@ -35,12 +40,7 @@ require (
 	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 	golang.org/x/term v0.22.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
-
-replace github.com/rclone/rclone => /home/corentin/Documents/work/ia/rclone
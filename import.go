@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// importDraintaskerCommand imports the Draintasker pack directories into the job's state
+func importDraintaskerCommand() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+
+	// The transfer directory belongs to a single job
+	if len(configs) > 1 {
+		return fmt.Errorf("%s lists %d jobs, select the one the transfer directory belongs to with --job", arguments.Config, len(configs))
+	}
+	config := configs[0]
+
+	store := warchangel.NewStateStore(warchangel.DefaultStatePath(config))
+
+	packs, err := warchangel.ImportDraintaskerPacks(config, logger, store, arguments.XferDir)
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		logger.Info("imported Draintasker pack", "item", pack.Item, "status", pack.Status, "files", len(pack.Files), "skipped", len(pack.Skipped), "moved", len(pack.Moved))
+	}
+
+	return printJSON(packs)
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"os/signal"
-	"syscall"
 
 	"github.com/internetarchive/warchangel/pkg/warchangel"
 )
@@ -13,31 +14,16 @@ var (
 	logger *slog.Logger
 )
 
-func signalHandler(doneChan chan struct{}) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-
-	go func() {
-		sigCount := 0
-		for {
-			sig := <-sigChan
-			sigCount++
-			if sigCount == 1 {
-				logger.Info("Received signal, initiating graceful shutdown", "signal", sig)
-				close(doneChan)
-			} else {
-				logger.Info("Received second signal, forcing shutdown", "signal", sig)
-				os.Exit(1)
-			}
-		}
-	}()
-}
-
 func main() {
 	argumentParsing(os.Args)
-	doneChan := make(chan struct{})
 
-	// Create a new logger
+	// Create a new logger, the daemon logs to stdout while the other
+	// commands keep stdout for their report
+	var output io.Writer = os.Stderr
+	if arguments.Command == "run" && !arguments.DryRun {
+		output = os.Stdout
+	}
+
 	level := slog.LevelInfo
 	addSource := false
 	if arguments.Debug {
@@ -45,56 +31,72 @@ func main() {
 		level = slog.LevelDebug
 	}
 
-	logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	logger = slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{
 		AddSource: addSource,
 		Level:     level,
 	}))
 
-	logger.Info("starting warchangel")
-	logger.Debug("config",
-		"threads", arguments.Threads,
-		"s3-access-key", arguments.S3AccessKey,
-		"s3-secret-key", arguments.S3SecretKey,
-		"s3-creds-file", arguments.S3CredsFile,
-		"config", arguments.Config,
-		"debug", arguments.Debug,
-	)
-
-	// Loading config file, if the file is YAML then we use the legacy draintasker config loader
-	// else it's a warchangel config file and it will be loaded as such
-	configType, err := warchangel.DetectConfigFormat(arguments.Config)
+	var err error
+	switch arguments.Command {
+	case "run":
+		err = runCommand()
+	case "plan":
+		err = planCommand()
+	case "status":
+		err = statusCommand()
+	case "verify":
+		err = verifyCommand()
+	case "retry":
+		err = retryCommand()
+	case "migrate-config":
+		err = migrateConfigCommand()
+	case "validate-config":
+		err = validateConfigCommand()
+	case "import-draintasker":
+		err = importDraintaskerCommand()
+	}
 	if err != nil {
-		logger.Error("error detecting config format", "err", err)
+		logger.Error(arguments.Command+" failed", "err", err)
 		os.Exit(1)
 	}
+}
 
-	var config *warchangel.Config
-	switch configType {
-	case warchangel.FormatYAML:
-		logger.Info("loading legacy Draintasker configuration")
-		config, err = warchangel.LoadDraintaskerConfig(arguments.Config)
-	case warchangel.FormatJSON:
-		logger.Info("loading warchangel configuration")
-		config, err = warchangel.LoadConfig(arguments.Config)
-	}
+// loadConfigs loads the configurations of the jobs the same way run does: a single warchangel or
+// Draintasker configuration, a jobs file or a directory of configurations. Only the job selected
+// with --job is kept if set.
+func loadConfigs() ([]*warchangel.Config, error) {
+	configs, err := warchangel.LoadJobs(arguments.Config)
 	if err != nil {
-		logger.Error("error loading config", "err", err)
-		os.Exit(1)
+		return nil, err
+	}
+
+	if arguments.Job == "" {
+		logger.Info("loaded jobs", "config", arguments.Config, "jobs", len(configs))
+		return configs, nil
 	}
 
-	// Start the watcher
-	go func() {
-		if err := warchangel.NewWatcher(config, logger, arguments.Threads, arguments.S3AccessKey, arguments.S3SecretKey, doneChan); err != nil {
-			logger.Error("watcher error", "err", err)
+	for _, config := range configs {
+		if config.Job == arguments.Job {
+			return []*warchangel.Config{config}, nil
 		}
-	}()
+	}
 
-	// Set up signal handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	return nil, fmt.Errorf("no job %s in %s", arguments.Job, arguments.Config)
+}
+
+// printJSON writes a command's report to stdout
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printJobsJSON writes the reports of a command run on each job: the report itself for a
+// single job, and the reports by job name for several
+func printJobsJSON(configs []*warchangel.Config, reports map[string]any) error {
+	if len(configs) == 1 {
+		return printJSON(reports[configs[0].Job])
+	}
 
-	// Wait for a termination signal
-	sig := <-sigChan
-	logger.Info("received signal, shutting down", "signal", sig)
-	close(doneChan)
+	return printJSON(reports)
 }
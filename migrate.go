@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// migrateConfigCommand converts a Draintasker configuration into a warchangel configuration
+// and reports the Draintasker keys that have no warchangel equivalent
+func migrateConfigCommand() error {
+	config, unmapped, err := warchangel.MigrateDraintaskerConfig(arguments.Config)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range unmapped {
+		logger.Warn("Draintasker key has no warchangel equivalent", "key", key.Key, "value", key.Value, "reason", key.Reason)
+	}
+
+	format := warchangel.FormatJSON
+	if arguments.Format == "yaml" {
+		format = warchangel.FormatYAML
+	}
+
+	data, err := warchangel.EncodeConfig(config, format)
+	if err != nil {
+		return err
+	}
+
+	if arguments.Output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	if err := os.WriteFile(arguments.Output, data, 0o644); err != nil {
+		return err
+	}
+
+	logger.Info("wrote warchangel configuration", "path", arguments.Output, "format", format, "unmapped", len(unmapped))
+
+	return nil
+}
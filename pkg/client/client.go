@@ -0,0 +1,120 @@
+// Package client submits finished WARC files to a running warchangel daemon through
+// its push API, so that crawlers don't wait for the next scan of their WARCs directory.
+// It doesn't depend on the uploader, crawlers can import it on its own.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SubmitPath is the path of the push API endpoint announcing a closed WARC file
+const SubmitPath = "/v1/files"
+
+// SubmitRequest announces that a WARC file is closed and can be uploaded
+type SubmitRequest struct {
+	// Path is the absolute path of the WARC file, in the WARCs directory of one of the daemon's jobs
+	Path string `json:"path"`
+	// Metadata is added to the item metadata of the file
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// SubmitResponse is the answer to an accepted SubmitRequest, the upload happens in the background
+type SubmitResponse struct {
+	File string `json:"file"`
+	Item string `json:"item"`
+}
+
+// ErrorResponse is the answer to a rejected request
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Error is a request rejected by the daemon
+type Error struct {
+	// StatusCode is the HTTP status of the answer: 400 for an invalid request, 404 for a file
+	// outside of the jobs' WARCs directories, 409 for a file already handled and 503 once the
+	// daemon is stopping
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("warchangel: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Client talks to the push API of a warchangel daemon
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New returns a client for the daemon listening on addr, either host:port or unix:/path/to/socket
+func New(addr string) *Client {
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return &Client{
+			baseURL: "http://warchangel",
+			httpClient: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socket)
+					},
+				},
+			},
+		}
+	}
+
+	return &Client{
+		baseURL:    "http://" + addr,
+		httpClient: &http.Client{},
+	}
+}
+
+// Submit announces that the WARC file at path is closed, the daemon queues it for upload right
+// away. metadata is added to the item metadata of the file, it can be nil.
+func (c *Client) Submit(ctx context.Context, path string, metadata map[string][]string) (*SubmitResponse, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(SubmitRequest{Path: path, Metadata: metadata})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+SubmitPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		var errResp ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			errResp.Error = resp.Status
+		}
+
+		return nil, &Error{StatusCode: resp.StatusCode, Message: errResp.Error}
+	}
+
+	var submitResp SubmitResponse
+	if err := json.NewDecoder(resp.Body).Decode(&submitResp); err != nil {
+		return nil, err
+	}
+
+	return &submitResp, nil
+}
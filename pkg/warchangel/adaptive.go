@@ -0,0 +1,178 @@
+package warchangel
+
+import (
+	"sync"
+	"time"
+)
+
+// adaptiveInterval is how often the jobs in adaptive mode adjust their number of parallel uploads
+const adaptiveInterval = 30 * time.Second
+
+// minThreads returns the lowest number of parallel uploads in adaptive mode
+func (c *Config) minThreads() int {
+	if c.MinThreads > 0 {
+		return c.MinThreads
+	}
+
+	return 1
+}
+
+// maxThreads returns the highest number of parallel uploads in adaptive mode
+func (c *Config) maxThreads() int {
+	if c.MaxThreads > 0 {
+		return c.MaxThreads
+	}
+
+	return max(2*c.Threads, c.minThreads())
+}
+
+// concurrency adjusts the number of parallel uploads of a job in adaptive mode: it adds an
+// upload while files wait for a slot and the job's throughput improves, takes it back when
+// the throughput didn't improve, and shrinks when archive.org asks to slow down or when the
+// latency of the uploads rises
+type concurrency struct {
+	mu sync.Mutex
+	// size is the number of parallel uploads, 0 until the adaptive mode starts
+	size int
+	// slowDowns and the latencies are the ones observed since the last step
+	slowDowns int
+	latency   time.Duration
+	latencies int
+	// baseline is the lowest average latency observed in a step
+	baseline time.Duration
+	// lastBytes is the number of bytes the job had sent at the last step, lastRate the rate
+	// between the last two steps
+	lastBytes int64
+	lastRate  float64
+	grew      bool
+	hold      bool
+}
+
+// slowDown records an upload that failed because archive.org asked to slow down
+func (a *concurrency) slowDown() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.slowDowns++
+}
+
+// observeLatency records how long the backend took to start reading a file
+func (a *concurrency) observeLatency(latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.latency += latency
+	a.latencies++
+}
+
+// current returns the number of parallel uploads, starting from the job's threads, within the bounds
+func (a *concurrency) current(c *Config) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size == 0 {
+		a.size = c.Threads
+	}
+	a.size = min(max(a.size, c.minThreads()), c.maxThreads())
+
+	return a.size
+}
+
+// reset leaves the adaptive mode, given the number of bytes sent by the job so far, it starts
+// over from the job's threads when enabled again
+func (a *concurrency) reset(bytes int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.size, a.slowDowns, a.latency, a.latencies, a.baseline = 0, 0, 0, 0, 0
+	a.lastBytes, a.lastRate, a.grew, a.hold = bytes, 0, false, false
+}
+
+// step adjusts the number of parallel uploads given the number of bytes sent by the job so far,
+// elapsed since the last step, and whether files are waiting for a slot. It returns the new
+// number and why it changed, if it did.
+func (a *concurrency) step(c *Config, bytes int64, elapsed time.Duration, saturated bool) (size int, reason string) {
+	current := a.current(c)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rate := float64(bytes-a.lastBytes) / elapsed.Seconds()
+
+	var latency time.Duration
+	if a.latencies > 0 {
+		latency = a.latency / time.Duration(a.latencies)
+	}
+
+	hold := a.hold
+	a.hold = false
+
+	size = current
+	switch {
+	case a.slowDowns > 0:
+		size, reason = current/2, "archive.org asked to slow down"
+	case a.baseline > 0 && latency > 2*a.baseline:
+		size, reason = current-1, "upload latency rose"
+	case a.grew && rate < a.lastRate*1.05:
+		// Give the previous size a step before trying again
+		size, reason = current-1, "throughput didn't improve"
+		a.hold = true
+	case saturated && !hold:
+		size, reason = current+1, "files are waiting for an upload slot"
+	}
+
+	size = min(max(size, c.minThreads()), c.maxThreads())
+	if size == current {
+		reason = ""
+	}
+
+	if latency > 0 && (a.baseline == 0 || latency < a.baseline) {
+		a.baseline = latency
+	}
+
+	a.grew = size > current
+	a.size = size
+	a.slowDowns, a.latency, a.latencies = 0, 0, 0
+	a.lastBytes, a.lastRate = bytes, rate
+
+	return size, reason
+}
+
+// adaptThreads adjusts the number of parallel uploads of the job every adaptiveInterval while
+// it's in adaptive mode, until the job stops
+func (j *job) adaptThreads() {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-j.done:
+			return
+		case now := <-ticker.C:
+			j.adapt(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// adapt adjusts the number of parallel uploads of the job if it's in adaptive mode
+func (j *job) adapt(elapsed time.Duration) {
+	throughput, _ := j.throughput.snapshot()
+	saturated := j.pending.Len() > 0
+
+	j.mu.Lock()
+	if !j.config.AdaptiveThreads || j.diskPressure {
+		j.concurrency.reset(throughput.Bytes)
+		j.mu.Unlock()
+		return
+	}
+
+	size, reason := j.concurrency.step(j.config, throughput.Bytes, elapsed, saturated)
+	j.applyLimits()
+	j.mu.Unlock()
+
+	if reason != "" {
+		j.logger.Info("adjusted upload threads", "threads", size, "reason", reason)
+	}
+}
@@ -0,0 +1,121 @@
+package warchangel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyStep(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.AdaptiveThreads = true
+	c.MinThreads = 2
+	c.MaxThreads = 6
+
+	var a concurrency
+	if size := a.current(c); size != 4 {
+		t.Fatalf("expected to start from the job's threads, got %d", size)
+	}
+
+	steps := []struct {
+		bytes     int64
+		saturated bool
+		slowDown  bool
+		latency   time.Duration
+		size      int
+		reason    string
+	}{
+		{bytes: 100, saturated: true, latency: 100 * time.Millisecond, size: 5, reason: "files are waiting for an upload slot"},
+		{bytes: 300, saturated: true, size: 6, reason: "files are waiting for an upload slot"},
+		{bytes: 500, saturated: true, size: 5, reason: "throughput didn't improve"},
+		// The previous size gets a step before growing again
+		{bytes: 700, saturated: true, size: 5},
+		{bytes: 900, saturated: true, slowDown: true, size: 2, reason: "archive.org asked to slow down"},
+		{bytes: 1100, saturated: true, size: 3, reason: "files are waiting for an upload slot"},
+		{bytes: 1500, saturated: true, latency: 300 * time.Millisecond, size: 2, reason: "upload latency rose"},
+		// Bounded by min_threads
+		{bytes: 1700, saturated: true, slowDown: true, size: 2},
+		{bytes: 1900, size: 2},
+	}
+
+	for i, step := range steps {
+		if step.slowDown {
+			a.slowDown()
+		}
+		if step.latency > 0 {
+			a.observeLatency(step.latency)
+		}
+
+		size, reason := a.step(c, step.bytes, time.Second, step.saturated)
+		if size != step.size || reason != step.reason {
+			t.Errorf("step %d: expected %d threads (%q), got %d (%q)", i, step.size, step.reason, size, reason)
+		}
+	}
+
+	// Bounded by max_threads
+	c.MaxThreads = 4
+	var bounded concurrency
+	if size, reason := bounded.step(c, 100, time.Second, true); size != 4 || reason != "" {
+		t.Errorf("expected to stay at max_threads, got %d (%q)", size, reason)
+	}
+}
+
+func TestJobAdapt(t *testing.T) {
+	c := testJobConfig(t, "test")
+	u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+
+	// Files wait for an upload slot
+	j.pending.push(queuedFile{name: "WEB-20240109170659538-00001-endgame.local.warc.gz"})
+
+	j.adapt(time.Second)
+	if j.pool.Size() != 4 {
+		t.Errorf("expected the job's threads without the adaptive mode, got %d", j.pool.Size())
+	}
+
+	next := *c
+	next.AdaptiveThreads = true
+	if _, err := j.reload(&next); err != nil {
+		t.Fatal(err)
+	}
+
+	j.adapt(time.Second)
+	if j.pool.Size() != 5 {
+		t.Errorf("expected the job to grow in adaptive mode, got %d", j.pool.Size())
+	}
+
+	// Disk pressure takes precedence, and the adaptive mode starts over afterwards
+	j.setDiskPressure(true, "test")
+	j.adapt(time.Second)
+	if j.pool.Size() != 8 {
+		t.Errorf("expected the disk pressure threads, got %d", j.pool.Size())
+	}
+
+	j.setDiskPressure(false, "test")
+	if j.pool.Size() != 4 {
+		t.Errorf("expected the adaptive mode to start over from the job's threads, got %d", j.pool.Size())
+	}
+}
+
+func TestIsSlowDown(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{err: nil},
+		{err: errors.New("connection reset by peer")},
+		{err: fmt.Errorf("put: %w", ErrSlowDown), expected: true},
+		{err: errors.New(`HTTP error 503 (503 Service Unavailable) returned body: "<Code>SlowDown</Code>"`), expected: true},
+		{err: errors.New("http error 429: 429 Too Many Requests"), expected: true},
+		{err: errors.New(`HTTP error 403 (403 Forbidden) returned body: ""`)},
+	}
+
+	for _, tc := range tests {
+		if got := isSlowDown(tc.err); got != tc.expected {
+			t.Errorf("isSlowDown(%v): expected %t, got %t", tc.err, tc.expected, got)
+		}
+	}
+}
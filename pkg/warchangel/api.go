@@ -0,0 +1,114 @@
+package warchangel
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/internetarchive/warchangel/pkg/client"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// SubmitHandler returns the push API of the Uploader, where crawlers announce closed WARC files
+// with POST /v1/files, see the client package. It queues uploads without any authentication, so
+// it should only be reachable by the crawlers, e.g. through a unix socket.
+func (u *Uploader) SubmitHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+client.SubmitPath, u.handleSubmit)
+
+	return mux
+}
+
+// StatusHandler returns the read-only HTTP API of the Uploader, to serve apart from the push API:
+// Prometheus scrapes GET /metrics, and GET /status describes the jobs next to the /healthz and
+// /readyz probes
+func (u *Uploader) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(u.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /status", u.handleStatus)
+	mux.HandleFunc("GET /healthz", u.handleHealth)
+	mux.HandleFunc("GET /readyz", u.handleReady)
+
+	return mux
+}
+
+func (u *Uploader) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req client.SubmitRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, client.ErrorResponse{Error: "invalid request: " + err.Error()})
+		return
+	}
+
+	if !filepath.IsAbs(req.Path) {
+		writeJSON(w, http.StatusBadRequest, client.ErrorResponse{Error: "the path must be absolute"})
+		return
+	}
+
+	item, err := u.Submit(req.Path, req.Metadata)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrUnknownFile):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrAlreadyHandled):
+			status = http.StatusConflict
+		case errors.Is(err, ErrStopped):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, ErrInvalidMetadata):
+			status = http.StatusBadRequest
+		}
+
+		writeJSON(w, status, client.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, client.SubmitResponse{File: filepath.Base(req.Path), Item: item})
+}
+
+func (u *Uploader) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, u.Status())
+}
+
+// handleHealth answers as long as the process serves the API
+func (u *Uploader) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady answers 503 before Run starts the jobs and once it's shutting down
+func (u *Uploader) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !u.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Listen listens on addr for the HTTP API, either host:port or unix:/path/to/socket.
+// A socket left over by a previous run is removed.
+func Listen(addr string) (net.Listener, error) {
+	socket, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", socket)
+}
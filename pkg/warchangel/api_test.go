@@ -0,0 +1,260 @@
+package warchangel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/internetarchive/warchangel/pkg/client"
+)
+
+// recordingBackend records the uploads it receives without sending them anywhere
+type recordingBackend struct {
+	mu       sync.Mutex
+	uploads  map[string]*Upload
+	uploaded chan string
+}
+
+func newRecordingBackend() *recordingBackend {
+	return &recordingBackend{uploads: make(map[string]*Upload), uploaded: make(chan string, 10)}
+}
+
+func (b *recordingBackend) Put(ctx context.Context, upload *Upload) (string, error) {
+	if _, err := io.Copy(io.Discard, upload.Body); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	b.uploads[upload.Filename] = upload
+	b.mu.Unlock()
+
+	b.uploaded <- upload.Filename
+
+	return upload.Item + "/" + upload.Filename, nil
+}
+
+func TestHandlerSubmit(t *testing.T) {
+	c := testJobConfig(t, "test")
+	// Scans must leave the files alone, only the submitted ones are uploaded
+	c.StabilityWait = 3600
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 600,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": 400,
+	})
+
+	backend := newRecordingBackend()
+	u, err := New(Options{
+		Jobs:    []*Config{c},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend: backend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "unix:" + filepath.Join(t.TempDir(), "warchangel.sock")
+	listener, err := Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: u.SubmitHandler()}
+	go server.Serve(listener)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	first := filepath.Join(c.WARCsDir, "WEB-20240109170659538-00001-endgame.local.warc.gz")
+	cl := client.New(addr)
+
+	resp, err := cl.Submit(context.Background(), first, map[string][]string{"seed": {"https://example.com/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.File != filepath.Base(first) || resp.Item != "WEB-20240109170659-endgame" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	select {
+	case name := <-backend.uploaded:
+		if name != filepath.Base(first) {
+			t.Fatalf("expected %s to be uploaded, got %s", filepath.Base(first), name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the submitted file to be uploaded")
+	}
+
+	backend.mu.Lock()
+	metadata := backend.uploads[filepath.Base(first)].Metadata
+	backend.mu.Unlock()
+	if seed := metadata["seed"]; len(seed) != 1 || seed[0] != "https://example.com/" {
+		t.Errorf("expected the submitted metadata to be added to the item metadata, got %v", metadata)
+	}
+	if collection := metadata["collection"]; len(collection) != 1 || collection[0] != "test" {
+		t.Errorf("expected the configured metadata to be kept, got %v", metadata)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		metadata map[string][]string
+		status   int
+	}{
+		{
+			name:   "already handled",
+			path:   first,
+			status: http.StatusConflict,
+		},
+		{
+			name:   "outside of the WARCs directories",
+			path:   filepath.Join(t.TempDir(), filepath.Base(first)),
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "missing file",
+			path:   filepath.Join(c.WARCsDir, "WEB-20240109170800000-00003-endgame.local.warc.gz"),
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "not a WARC file",
+			path:   filepath.Join(c.WARCsDir, "WEB-20240109170800000-00003-endgame.local.warc.gz.open"),
+			status: http.StatusNotFound,
+		},
+		{
+			name:     "invalid metadata key",
+			path:     filepath.Join(c.WARCsDir, "WEB-20240109170700000-00002-endgame.local.warc.gz"),
+			metadata: map[string][]string{"Seed URL": {"https://example.com/"}},
+			status:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := cl.Submit(context.Background(), tc.path, tc.metadata)
+
+			var clientErr *client.Error
+			if !errors.As(err, &clientErr) || clientErr.StatusCode != tc.status {
+				t.Errorf("expected a %d error, got %v", tc.status, err)
+			}
+		})
+	}
+
+	// Requests that can't be decoded are rejected
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", strings.TrimPrefix(addr, "unix:"))
+		},
+	}}
+	badResp, err := httpClient.Post("http://warchangel"+client.SubmitPath, "application/json", strings.NewReader(`{"file": "x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badResp.Body.Close()
+	if badResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid request to be rejected, got %s", badResp.Status)
+	}
+
+	cancel()
+	<-stopped
+
+	_, err = cl.Submit(context.Background(), filepath.Join(c.WARCsDir, "WEB-20240109170700000-00002-endgame.local.warc.gz"), nil)
+	var clientErr *client.Error
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected submitting to a stopped uploader to fail, got %v", err)
+	}
+}
+
+func TestStatusHandlerReadOnly(t *testing.T) {
+	c := testJobConfig(t, "test")
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 600,
+	})
+
+	u, err := New(Options{
+		Jobs:    []*Config{c},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend: newRecordingBackend(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := httptest.NewServer(u.StatusHandler())
+	defer status.Close()
+	submit := httptest.NewServer(u.SubmitHandler())
+	defer submit.Close()
+
+	// Whoever reaches the metrics can't queue uploads
+	body := `{"path": "` + filepath.Join(c.WARCsDir, "WEB-20240109170659538-00001-endgame.local.warc.gz") + `"}`
+	resp, err := http.Post(status.URL+client.SubmitPath, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the read-only API to reject submissions with 404, got %s", resp.Status)
+	}
+	if stats := u.Stats(); stats.Queued != 0 {
+		t.Errorf("expected nothing to be queued, got %+v", stats)
+	}
+
+	// And the push API doesn't serve the metrics nor the status
+	for _, path := range []string{"/metrics", "/status", "/healthz", "/readyz"} {
+		resp, err := http.Get(submit.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected the push API not to serve %s, got %s", path, resp.Status)
+		}
+	}
+}
+
+func TestJobScanStabilityWait(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.StabilityWait = 60
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 600,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": 400,
+	})
+
+	stable := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(filepath.Join(c.WARCsDir, stable), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newRecordingBackend()
+	u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Backend: backend})
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+
+	j.scan()
+	j.startQueued()
+	j.pool.Wait()
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if len(backend.uploads) != 1 || backend.uploads[stable] == nil {
+		t.Errorf("expected only the stable file to be uploaded, got %v", backend.uploads)
+	}
+}
@@ -0,0 +1,123 @@
+package warchangel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload describes a WARC file to upload into an item
+type Upload struct {
+	Item     string
+	Filename string
+	Size     int64
+	ModTime  time.Time
+	// MD5 is the hex encoded MD5 checksum of the file, empty if it wasn't computed
+	MD5      string
+	Metadata ItemMetadata
+	// Derive queues the derivation of the item once the file is uploaded
+	Derive bool
+	Body   io.Reader
+}
+
+// Backend sends WARC files to the Internet Archive
+type Backend interface {
+	// Put uploads a file into its item, creating the item if needed,
+	// and returns the path of the uploaded file. Errors caused by archive.org
+	// asking to slow down should wrap ErrSlowDown.
+	Put(ctx context.Context, upload *Upload) (remote string, err error)
+}
+
+// MetadataBackend is implemented by the backends able to add metadata to an existing item.
+// archive.org only applies the metadata sent along with a file when the file creates its
+// item, so the metadata submitted with the files of existing items goes through it.
+type MetadataBackend interface {
+	// UpdateMetadata adds the values of metadata to the metadata of an existing item
+	UpdateMetadata(ctx context.Context, item string, metadata ItemMetadata) error
+}
+
+// ErrSlowDown is returned by the backends when archive.org asks to reduce the request rate
+var ErrSlowDown = errors.New("archive.org asked to slow down")
+
+// ErrUnsupportedUpload is wrapped by the errors of the backends that can't carry out an upload
+// as asked, such as creating its item with its metadata. Retrying the upload wouldn't help.
+var ErrUnsupportedUpload = errors.New("the backend can't carry out the upload")
+
+// isSlowDown reports whether an upload error means that archive.org is overloaded: 503 SlowDown
+// and 429 responses. The errors of rclone's backend only tell through their message.
+func isSlowDown(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrSlowDown) {
+		return true
+	}
+
+	message := err.Error()
+	for _, pattern := range []string{"SlowDown", "HTTP error 503", "HTTP error 429", "http error 503", "http error 429"} {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DryRunFile is a WARC file that would have been uploaded
+type DryRunFile struct {
+	Name    string            `json:"name"`
+	Size    int64             `json:"size"`
+	MD5     string            `json:"md5,omitempty"`
+	Headers map[string]string `json:"headers"`
+}
+
+// DryRunItem is an item that would have been created or filled
+type DryRunItem struct {
+	Identifier string       `json:"identifier"`
+	Size       int64        `json:"size"`
+	Files      []DryRunFile `json:"files"`
+}
+
+// dryRunBackend doesn't upload anything, it records what would have been uploaded
+type dryRunBackend struct {
+	logger *slog.Logger
+	mu     sync.Mutex
+	items  []*DryRunItem
+}
+
+func (b *dryRunBackend) Put(ctx context.Context, upload *Upload) (remote string, err error) {
+	headers := upload.Metadata.Headers()
+
+	b.logger.Info("dry-run: not uploading file", "file", upload.Filename, "item", upload.Item, "size", upload.Size, "md5", upload.MD5, "headers", headers)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var item *DryRunItem
+	for _, i := range b.items {
+		if i.Identifier == upload.Item {
+			item = i
+			break
+		}
+	}
+
+	if item == nil {
+		item = &DryRunItem{Identifier: upload.Item}
+		b.items = append(b.items, item)
+	}
+
+	item.Size += upload.Size
+	item.Files = append(item.Files, DryRunFile{
+		Name:    upload.Filename,
+		Size:    upload.Size,
+		MD5:     upload.MD5,
+		Headers: headers,
+	})
+
+	return upload.Item + "/" + upload.Filename, nil
+}
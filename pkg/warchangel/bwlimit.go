@@ -0,0 +1,111 @@
+package warchangel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/time/rate"
+)
+
+// parseBandwidthLimit parses a bandwidth limit in rclone's --bwlimit syntax: a rate such as 20M,
+// in bytes per second, or a timetable such as "Mon-08:00,20M Mon-19:00,off". An empty limit
+// returns an empty timetable, which doesn't limit anything.
+func parseBandwidthLimit(limit string) (fs.BwTimetable, error) {
+	if limit == "" {
+		return nil, nil
+	}
+
+	var timetable fs.BwTimetable
+	if err := timetable.Set(limit); err != nil {
+		return nil, err
+	}
+
+	return timetable, nil
+}
+
+// bandwidthLimiter caps the rate at which bytes are sent to the one of its timetable's slot
+// in effect, nil limits nothing
+type bandwidthLimiter struct {
+	mu        sync.Mutex
+	timetable fs.BwTimetable
+	limiter   *rate.Limiter
+	// limit is the rate in bytes per second the limiter was set to, 0 when unlimited
+	limit int64
+}
+
+func newBandwidthLimiter(timetable fs.BwTimetable) *bandwidthLimiter {
+	return &bandwidthLimiter{timetable: timetable, limiter: rate.NewLimiter(rate.Inf, 0)}
+}
+
+// setTimetable replaces the timetable, the uploads in progress follow it from their next read
+func (l *bandwidthLimiter) setTimetable(timetable fs.BwTimetable) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.timetable = timetable
+}
+
+// current returns the rate limiter for the slot of the timetable in effect at now, nil if unlimited
+func (l *bandwidthLimiter) current(now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := int64(l.timetable.LimitAt(now).Bandwidth.Tx)
+	if limit <= 0 {
+		l.limit = 0
+		return nil
+	}
+
+	if limit != l.limit {
+		l.limit = limit
+		l.limiter.SetLimitAt(now, rate.Limit(limit))
+		l.limiter.SetBurstAt(now, int(limit))
+	}
+
+	return l.limiter
+}
+
+// wait blocks until n bytes can be sent within the limit, or until ctx is done
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	for n > 0 {
+		limiter := l.current(time.Now())
+		if limiter == nil {
+			return nil
+		}
+
+		// A single wait can't exceed the burst, a second's worth of bytes
+		chunk := min(n, limiter.Burst())
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// throttledReader waits after each read of r for the bytes to fit within every limiter
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*bandwidthLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	for _, limiter := range r.limiters {
+		if waitErr := limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,91 @@
+package warchangel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	timetable, err := parseBandwidthLimit("Mon-08:00,20M Mon-19:00,off")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monday := time.Date(2024, time.January, 8, 0, 0, 0, 0, time.Local)
+	limiter := newBandwidthLimiter(timetable)
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		expected int64
+	}{
+		{name: "business hours", at: monday.Add(10 * time.Hour), expected: 20 << 20},
+		{name: "night", at: monday.Add(20 * time.Hour)},
+		// The last slot of the week wraps around
+		{name: "before the first slot", at: monday.Add(7 * time.Hour)},
+		{name: "next day", at: monday.Add(34 * time.Hour)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			current := limiter.current(tc.at)
+			if tc.expected == 0 {
+				if current != nil {
+					t.Errorf("expected no limit, got %v", current.Limit())
+				}
+				return
+			}
+
+			if current == nil || int64(current.Limit()) != tc.expected || int64(current.Burst()) != tc.expected {
+				t.Errorf("expected a limit of %d bytes per second, got %+v", tc.expected, current)
+			}
+		})
+	}
+
+	if _, err := parseBandwidthLimit("20 megabytes"); err == nil {
+		t.Error("expected an invalid limit to be rejected")
+	}
+
+	var unlimited *bandwidthLimiter
+	if err := unlimited.wait(context.Background(), 1<<30); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	timetable, err := parseBandwidthLimit("20k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20k at 20k per second
+	data := bytes.Repeat([]byte("x"), 20<<10)
+	r := &throttledReader{
+		ctx:      context.Background(),
+		r:        bytes.NewReader(data),
+		limiters: []*bandwidthLimiter{newBandwidthLimiter(nil), newBandwidthLimiter(timetable)},
+	}
+
+	started := time.Now()
+	read, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Error("unexpected data")
+	}
+	if elapsed := time.Since(started); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected reading to take about a second, took %s", elapsed)
+	}
+
+	// A limited read stops waiting once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r = &throttledReader{ctx: ctx, r: bytes.NewReader(data), limiters: []*bandwidthLimiter{newBandwidthLimiter(timetable)}}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected the read to stop with the context")
+	}
+}
@@ -1,9 +1,14 @@
 package warchangel
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -23,8 +28,13 @@ const (
 	FormatUnknown ConfigFormat = iota
 	FormatJSON
 	FormatYAML
+	FormatDraintasker
 )
 
+// ConfigVersion is the version of the configuration schema this warchangel
+// supports, configurations without a version are considered to be version 1
+const ConfigVersion = 1
+
 // String provides a string representation for ConfigFormat values.
 func (f ConfigFormat) String() string {
 	switch f {
@@ -32,20 +42,92 @@ func (f ConfigFormat) String() string {
 		return "json"
 	case FormatYAML:
 		return "yaml"
+	case FormatDraintasker:
+		return "draintasker"
 	default:
 		return "unknown"
 	}
 }
 
 type Config struct {
+	// Version of the configuration schema
+	Version int `json:"version"`
 	// Job name
 	Job string `json:"job"`
-	// Directory where the WARCs are stored
+	// Directory where the WARCs are stored, files under it are tracked by their relative path
 	WARCsDir string `json:"warcs"`
+	// Roots are more directories scanned like WARCsDir, e.g. the job directories of several
+	// Heritrix instances, their files are tracked by their path relative to their root
+	Roots []string `json:"roots,omitempty"`
+	// Recursive scans the subdirectories of the scanned directories too
+	Recursive bool `json:"recursive,omitempty"`
+	// Include are glob patterns, relative to WARCsDir and to each root, of the directories to scan
+	// instead of the roots themselves, e.g. jobs/*/*/warcs for Heritrix's launch directories
+	Include []string `json:"include,omitempty"`
+	// Exclude are glob patterns of the files and directories to skip, matched against the path
+	// relative to their root if they contain a slash, and against the name otherwise
+	Exclude []string `json:"exclude,omitempty"`
 	// ScanInterval is the number of seconds between each scan of the WARCs directory
 	ScanInterval int `json:"scan_interval"`
+	// StabilityWait is the number of seconds a WARC file must stay unchanged before a scan
+	// uploads it, files submitted through the push API are uploaded right away
+	StabilityWait int `json:"stability_wait,omitempty"`
 	// Target item size in gigabytes
 	ItemSize int `json:"item_size"`
+	// Threads is the number of parallel uploads
+	Threads int `json:"threads,omitempty"`
+	// ItemThreads is the highest number of parallel uploads into a single item, 2 by default, 0 for no
+	// limit. The first upload into an item that doesn't exist yet is always alone, so that the item is
+	// created once.
+	ItemThreads *int `json:"item_threads,omitempty"`
+	// AdaptiveThreads adjusts the number of parallel uploads between MinThreads and MaxThreads, starting
+	// from Threads: it grows while files wait for an upload slot and the throughput improves, and
+	// shrinks when archive.org asks to slow down or when the latency of the uploads rises
+	AdaptiveThreads bool `json:"adaptive_threads,omitempty"`
+	// MinThreads is the lowest number of parallel uploads in adaptive mode, 1 by default
+	MinThreads int `json:"min_threads,omitempty"`
+	// MaxThreads is the highest number of parallel uploads in adaptive mode, twice Threads by default
+	MaxThreads int `json:"max_threads,omitempty"`
+	// DiskHighWater is the usage of the filesystem holding WARCsDir, in percent, from which the job
+	// drains it as fast as it can, 0 disables the monitoring
+	DiskHighWater int `json:"disk_high_water,omitempty"`
+	// DiskLowWater is the usage under which the job goes back to normal, DiskHighWater - 5 by default
+	DiskLowWater int `json:"disk_low_water,omitempty"`
+	// DiskPressureThreads is the number of parallel uploads above the high-water mark, twice Threads by default
+	DiskPressureThreads int `json:"disk_pressure_threads,omitempty"`
+	// PauseFile is a marker file, relative to WARCsDir if not absolute, created above the high-water
+	// mark so that the crawler wrappers throttle writing, and removed once the usage is back to normal
+	PauseFile string `json:"pause_file,omitempty"`
+	// ProgressInterval is the number of seconds between the progress logs of each upload, 60 by default
+	ProgressInterval int `json:"progress_interval,omitempty"`
+	// StallAfter is the number of seconds without any byte sent after which an upload is reported stalled, 60 by default
+	StallAfter int `json:"stall_after,omitempty"`
+	// UploadTimeout is the number of seconds after which the sending of a file is cancelled and the file
+	// is retried, 0 means no limit
+	UploadTimeout int `json:"upload_timeout,omitempty"`
+	// InactivityTimeout is the number of seconds without any byte sent after which the sending of a file
+	// is cancelled and the file is retried, 0 means no limit. Waiting for archive.org's answer once the
+	// whole file is sent doesn't count, only UploadTimeout limits it.
+	InactivityTimeout int `json:"inactivity_timeout,omitempty"`
+	// RetryDelay is the number of seconds after which a file whose upload timed out or failed to be sent
+	// is queued again, doubling with each retry, 60 by default
+	RetryDelay int `json:"retry_delay,omitempty"`
+	// MaxRetries is the number of times such a file is queued again before it fails and waits for the
+	// retry command, 3 by default
+	MaxRetries int `json:"max_retries,omitempty"`
+	// BlockDelay is the number of seconds the uploads of every job pause when archive.org asks an upload
+	// of the job to slow down, 300 by default. The file of that upload is queued again.
+	BlockDelay int `json:"block_delay,omitempty"`
+	// MaxBlockCount is the number of pauses in a row, without any upload going through, after which
+	// the files asked to slow down fail instead of being queued again, 0 means no limit
+	MaxBlockCount int `json:"max_block_count,omitempty"`
+	// BandwidthLimit caps the rate of the job's uploads together, in rclone's --bwlimit syntax: a number of
+	// bytes per second such as 20M, or a timetable such as "Mon-08:00,20M Mon-19:00,off". No limit by default.
+	BandwidthLimit string `json:"bwlimit,omitempty"`
+	// UploadBandwidthLimit caps the rate of each upload of the job, in the same syntax as BandwidthLimit
+	UploadBandwidthLimit string `json:"upload_bwlimit,omitempty"`
+	// Order is the order in which the files waiting for an upload slot are uploaded, by name by default
+	Order UploadOrder `json:"upload_order,omitempty"`
 	// WARC naming convention
 	WARCNaming WARCNaming `json:"warc_naming"`
 	// Description inserted in the item's metadata
@@ -60,6 +142,12 @@ type Config struct {
 	Metadata map[string][]string `json:"subject"`
 	// Derive flag, if set to 0 the item will not be derived
 	Derive int `json:"derive"`
+	// VerifyCompression checks that the gzip or zstd stream of each WARC file decodes before uploading it
+	VerifyCompression bool `json:"verify_compression"`
+	// MD5 computes the MD5 checksum of each WARC file and has archive.org check it
+	MD5 bool `json:"md5"`
+	// StateFile is where warchangel keeps track of files and items, defaults to .warchangel-state.json in WARCsDir
+	StateFile string `json:"state_file,omitempty"`
 }
 
 type draintaskerConfig struct {
@@ -76,7 +164,7 @@ type draintaskerConfig struct {
 	RetryDelay     int                 `yaml:"retry_delay"`
 	Description    string              `yaml:"description"`
 	Operator       string              `yaml:"operator"`
-	Collections    []string            `yaml:"collections"`
+	Collections    draintaskerList     `yaml:"collections"`
 	TitlePrefix    string              `yaml:"title_prefix"`
 	Creator        string              `yaml:"creator"`
 	Sponsor        string              `yaml:"sponsor"`
@@ -87,77 +175,320 @@ type draintaskerConfig struct {
 	CompactNames   int                 `yaml:"compact_names"`
 }
 
-// DetectConfigFormat attempts to determine if data is JSON or YAML.
-// Returns the appropriate ConfigFormat and an error if neither is detected.
+// DetectConfigFormat determines if a configuration file is a warchangel configuration,
+// written in JSON or YAML, or a legacy Draintasker configuration, recognized by its
+// distinctive crawljob and job_dir keys. Returns an error if the format isn't detected.
 func DetectConfigFormat(path string) (ConfigFormat, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return FormatUnknown, err
 	}
 
-	var jsonObj interface{}
-	if err := json.Unmarshal(data, &jsonObj); err == nil {
+	// Draintasker configurations are always YAML
+	if json.Valid(data) {
 		return FormatJSON, nil
 	}
 
-	var yamlObj interface{}
-	if err := yaml.Unmarshal(data, &yamlObj); err == nil {
-		return FormatYAML, nil
+	var yamlObj map[string]interface{}
+	if err := yaml.Unmarshal(data, &yamlObj); err != nil {
+		return FormatUnknown, fmt.Errorf("data is neither valid JSON nor YAML")
+	}
+
+	for _, key := range []string{"crawljob", "job_dir"} {
+		if _, ok := yamlObj[key]; ok {
+			return FormatDraintasker, nil
+		}
 	}
 
-	return FormatUnknown, fmt.Errorf("data is neither valid JSON nor YAML")
+	return FormatYAML, nil
 }
 
-// LoadConfig loads a warchangel configuration file (JSON)
+// LoadConfig loads a warchangel configuration file (JSON or YAML), fills the
+// optional values that aren't set and validates it
 func LoadConfig(path string) (c *Config, err error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = normalizeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadConfigData(data)
+}
+
+// normalizeConfig returns a warchangel configuration as JSON. YAML configurations go
+// through the JSON decoder so that both formats share the same keys, strictness and
+// error messages.
+func normalizeConfig(data []byte) ([]byte, error) {
+	if json.Valid(data) {
+		return data, nil
+	}
+
+	return yamlToJSON(data)
+}
+
+// loadConfigData decodes a JSON warchangel configuration, sets its defaults and validates it
+func loadConfigData(data []byte) (*Config, error) {
+	cfg, err := decodeConfig(data)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
+	cfg.SetDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// decodeConfig decodes a JSON configuration, rejecting unknown keys
+func decodeConfig(data []byte) (*Config, error) {
 	var cfg Config
-	if err := decoder.Decode(&cfg); err != nil {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(&cfg)
+	if err == nil {
+		return &cfg, nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return nil, &ValidationError{Problems: []FieldError{{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value),
+		}}}
+	}
+
+	if !strings.HasPrefix(err.Error(), "json: unknown field") {
+		return nil, err
+	}
+
+	// The decoder stops at the first unknown key, list all of them and
+	// validate the rest of the configuration to report everything at once
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
 		return nil, err
 	}
 
-	return &cfg, nil
+	known := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(cfg)) {
+		known[strings.Split(field.Tag.Get("json"), ",")[0]] = true
+	}
+
+	var problems []FieldError
+	for key := range raw {
+		if !known[key] {
+			problems = append(problems, FieldError{Field: key, Message: "unknown field"})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Field < problems[j].Field
+	})
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.SetDefaults()
+
+	var validationErr *ValidationError
+	if errors.As(cfg.Validate(), &validationErr) {
+		problems = append(problems, validationErr.Problems...)
+	}
+
+	return nil, &ValidationError{Problems: problems}
 }
 
-// LoadDraintaskerConfig loads a Draintasker configuration file (YAML)
+// EncodeConfig encodes a warchangel configuration in JSON or YAML
+func EncodeConfig(c *Config, format ConfigFormat) ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatJSON:
+		return append(data, '\n'), nil
+	case FormatYAML:
+		// Going through a MapSlice keeps the keys in the order of the JSON encoding
+		var obj yaml.MapSlice
+		if err := yaml.Unmarshal(data, &obj); err != nil {
+			return nil, err
+		}
+
+		return yaml.Marshal(obj)
+	default:
+		return nil, fmt.Errorf("unable to encode configuration as %s", format)
+	}
+}
+
+// yamlToJSON converts a YAML document into its JSON equivalent
+func yamlToJSON(data []byte) ([]byte, error) {
+	var obj interface{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonCompatible(obj))
+}
+
+// jsonCompatible converts the map[interface{}]interface{} produced by the YAML decoder into map[string]interface{}
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// draintaskerList is a list that can either be written as a YAML sequence
+// or as a single string with its values separated by slashes
+type draintaskerList []string
+
+func (l *draintaskerList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	*l = nil
+	for _, v := range strings.Split(value, "/") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+
+	return nil
+}
+
+// draintaskerUnmappedKeys are the Draintasker keys that have no warchangel equivalent
+var draintaskerUnmappedKeys = map[string]string{
+	"xfer_dir":      "warchangel uploads WARC files from the WARCs directory, there is no transfer directory",
+	"compact_names": "warchangel always names items {TLA}-{timestamp}-{host}",
+}
+
+// UnmappedKey is a Draintasker configuration key that couldn't be migrated
+type UnmappedKey struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// LoadDraintaskerConfig loads a Draintasker configuration file (YAML), fills the
+// optional values that aren't set and validates the resulting warchangel configuration
 func LoadDraintaskerConfig(path string) (c *Config, err error) {
-	file, err := os.Open(path)
+	c, _, err = MigrateDraintaskerConfig(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	var dtCfg draintaskerConfig
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&dtCfg); err != nil {
+	c.SetDefaults()
+
+	if err := c.Validate(); err != nil {
 		return nil, err
 	}
 
+	return c, nil
+}
+
+// MigrateDraintaskerConfig loads a Draintasker configuration file (YAML) and converts it
+// into a warchangel configuration, reporting every key that has no warchangel equivalent.
+func MigrateDraintaskerConfig(path string) (c *Config, unmapped []UnmappedKey, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dtCfg draintaskerConfig
+	if err := yaml.Unmarshal(data, &dtCfg); err != nil {
+		return nil, nil, err
+	}
+
 	// Transform Draintasker configuration into warchangel configuration
+	itemThreads := DefaultItemThreads
 	cfg := Config{
-		Job:          dtCfg.Crawljob,
-		WARCsDir:     dtCfg.JobDir,
-		ScanInterval: dtCfg.SleepTime,
-		ItemSize:     dtCfg.MaxSize,
-		WARCNaming:   WARCNaming(dtCfg.WARCNaming),
-		Description:  dtCfg.Description,
-		Collections:  dtCfg.Collections,
-		TitlePrefix:  dtCfg.TitlePrefix,
-		Metadata:     dtCfg.Metadata,
-		Derive:       dtCfg.Derive,
-	}
-
-	cfg.Metadata["creator"] = []string{dtCfg.Creator}
-	cfg.Metadata["sponsor"] = []string{dtCfg.Sponsor}
-	cfg.Metadata["contributor"] = []string{dtCfg.Contributor}
-	cfg.Metadata["scanningcenter"] = []string{dtCfg.ScanningCenter}
-	cfg.Metadata["operator"] = []string{dtCfg.Operator}
-
-	return &cfg, nil
+		Version:           ConfigVersion,
+		Job:               dtCfg.Crawljob,
+		WARCsDir:          dtCfg.JobDir,
+		ScanInterval:      dtCfg.SleepTime,
+		ItemSize:          dtCfg.MaxSize,
+		Threads:           DefaultThreads,
+		ItemThreads:       &itemThreads,
+		WARCNaming:        WARCNaming(dtCfg.WARCNaming),
+		Description:       dtCfg.Description,
+		Operator:          dtCfg.Operator,
+		Collections:       dtCfg.Collections,
+		TitlePrefix:       dtCfg.TitlePrefix,
+		Metadata:          dtCfg.Metadata,
+		Derive:            dtCfg.Derive,
+		VerifyCompression: intToBool(dtCfg.VerifyGzip),
+		MD5:               intToBool(dtCfg.Md5sum),
+		BlockDelay:        dtCfg.BlockDelay,
+		RetryDelay:        dtCfg.RetryDelay,
+		MaxBlockCount:     dtCfg.MaxBlockCount,
+	}
+
+	if cfg.Metadata == nil {
+		cfg.Metadata = make(map[string][]string)
+	}
+
+	for key, value := range map[string]string{
+		"creator":        dtCfg.Creator,
+		"sponsor":        dtCfg.Sponsor,
+		"contributor":    dtCfg.Contributor,
+		"scanningcenter": dtCfg.ScanningCenter,
+	} {
+		if value != "" {
+			cfg.Metadata[key] = []string{value}
+		}
+	}
+
+	// Look at the raw keys to report the ones that are set but can't be migrated
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(dtCfg)) {
+		known[field.Tag.Get("yaml")] = true
+	}
+
+	for key, value := range raw {
+		if reason, ok := draintaskerUnmappedKeys[key]; ok {
+			unmapped = append(unmapped, UnmappedKey{Key: key, Value: fmt.Sprint(value), Reason: reason})
+		} else if !known[key] {
+			unmapped = append(unmapped, UnmappedKey{Key: key, Value: fmt.Sprint(value), Reason: "unknown Draintasker key"})
+		}
+	}
+
+	sort.Slice(unmapped, func(i, j int) bool {
+		return unmapped[i].Key < unmapped[j].Key
+	})
+
+	return &cfg, unmapped, nil
 }
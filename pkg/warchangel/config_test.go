@@ -0,0 +1,234 @@
+package warchangel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateDraintaskerConfig(t *testing.T) {
+	itemThreads := 2
+	tests := []struct {
+		file     string
+		expected Config
+		unmapped []string
+	}{
+		{
+			file: "wide.yml",
+			expected: Config{
+				Version:      ConfigVersion,
+				Job:          "wide-00016",
+				WARCsDir:     "/3/crawling/heritrix/jobs/wide-00016/latest/warcs",
+				ScanInterval: 300,
+				ItemSize:     10,
+				Threads:      4,
+				ItemThreads:  &itemThreads,
+				WARCNaming:   HeritrixWARCNaming,
+				Description:  "Wide crawl number 16. This is data from a wide crawl of the web.",
+				Operator:     "crawl@archive.org",
+				Collections:  []string{"wide00016", "widecrawl"},
+				TitlePrefix:  "Wide Crawl Number 16",
+				Metadata: map[string][]string{
+					"creator":        {"Internet Archive"},
+					"sponsor":        {"Internet Archive"},
+					"contributor":    {"Internet Archive"},
+					"scanningcenter": {"sanfrancisco"},
+				},
+				Derive:            1,
+				VerifyCompression: true,
+				MD5:               true,
+				RetryDelay:        1800,
+				BlockDelay:        1800,
+				MaxBlockCount:     8,
+			},
+			unmapped: []string{"compact_names", "xfer_dir"},
+		},
+		{
+			file: "zeno.yml",
+			expected: Config{
+				Version:      ConfigVersion,
+				Job:          "zeno-focused",
+				WARCsDir:     "/1/zeno/jobs/focused/warcs",
+				ScanInterval: 60,
+				ItemSize:     5,
+				Threads:      4,
+				ItemThreads:  &itemThreads,
+				WARCNaming:   ZenoWARCNaming,
+				Description:  "Focused crawl of news websites",
+				Operator:     "focused@archive.org",
+				Collections:  []string{"focused_crawls", "news_crawls"},
+				TitlePrefix:  "Focused Crawl",
+				Metadata: map[string][]string{
+					"subject": {"news", "web"},
+					"creator": {"Internet Archive"},
+				},
+				MD5: true,
+			},
+			unmapped: []string{"pack_dir"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			migrated, unmapped, err := MigrateDraintaskerConfig(filepath.Join("testdata", "draintasker", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*migrated, tc.expected) {
+				t.Errorf("unexpected migrated configuration\ngot:      %+v\nexpected: %+v", *migrated, tc.expected)
+			}
+
+			var keys []string
+			for _, key := range unmapped {
+				keys = append(keys, key.Key)
+			}
+			if !reflect.DeepEqual(keys, tc.unmapped) {
+				t.Errorf("expected unmapped keys %v, got %v", tc.unmapped, keys)
+			}
+
+			// The migrated configuration must load back as the same warchangel configuration in both formats
+			for _, format := range []ConfigFormat{FormatJSON, FormatYAML} {
+				data, err := EncodeConfig(migrated, format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				path := filepath.Join(t.TempDir(), "warchangel."+format.String())
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				detected, err := DetectConfigFormat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if detected != format {
+					t.Fatalf("expected the migrated configuration to be detected as %s, got %s", format, detected)
+				}
+
+				loaded, err := LoadConfig(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(loaded, migrated) {
+					t.Errorf("configuration changed after a %s round-trip\ngot:      %+v\nexpected: %+v", format, loaded, migrated)
+				}
+			}
+
+			// The Draintasker configuration itself is detected as such
+			detected, err := DetectConfigFormat(filepath.Join("testdata", "draintasker", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected != FormatDraintasker {
+				t.Errorf("expected %s to be detected as a Draintasker configuration, got %s", tc.file, detected)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		problems    []string
+		itemThreads int
+	}{
+		{
+			name:        "valid with defaults",
+			config:      `{"job": "test", "warcs": "/tmp", "warc_naming": 1, "collections": ["test"]}`,
+			itemThreads: DefaultItemThreads,
+		},
+		{
+			name:   "no limit per item",
+			config: `{"job": "test", "warcs": "/tmp", "warc_naming": 1, "collections": ["test"], "item_threads": 0}`,
+		},
+		{
+			name: "every problem at once",
+			config: `{"job": "", "warcs": "", "scan_interval": -1, "warc_naming": 3, "collections": ["ok", "not ok"],
+				"subject": {"Bad Key": ["x"]}, "derive": 2, "scan_intervall": 10, "pack_dir": "/tmp"}`,
+			problems: []string{
+				"pack_dir: unknown field",
+				"scan_intervall: unknown field",
+				"job: must be set",
+				"warcs: must be set",
+				"scan_interval: must be a positive number of seconds, got -1",
+				"warc_naming: unknown WARC naming convention 3, must be 1 (Zeno) or 2 (Heritrix)",
+				`collections[1]: "not ok" is not a valid collection identifier`,
+				"subject.Bad Key: metadata keys must be lowercase letters, digits, - or _",
+				"derive: must be 0 or 1, got 2",
+			},
+		},
+		{
+			name: "nested roots",
+			config: `{"job": "test", "warcs": "/warcs", "warc_naming": 1, "collections": ["test"],
+				"roots": ["/heritrix", "/heritrix/jobs/a", "/", ""], "include": ["../jobs/*/warcs"]}`,
+			problems: []string{
+				"roots[1]: must not be under roots[0]",
+				"roots[2]: must not hold warcs",
+				"roots[2]: must not hold roots[0]",
+				"roots[2]: must not hold roots[1]",
+				"roots[3]: must be set",
+				"include[0]: must be relative to the roots and stay under them, list the other directories in roots",
+			},
+		},
+		{
+			name:     "wrong type",
+			config:   `{"job": "test", "scan_interval": "30"}`,
+			problems: []string{"scan_interval: expected int, got string"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "warchangel.json")
+			if err := os.WriteFile(path, []byte(tc.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := LoadConfig(path)
+			if len(tc.problems) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.ScanInterval != DefaultScanInterval || c.ItemSize != DefaultItemSize ||
+					c.ItemThreads == nil || *c.ItemThreads != tc.itemThreads {
+					t.Errorf("expected defaults to be applied, got %+v", c)
+				}
+				return
+			}
+
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+
+			var problems []string
+			for _, problem := range validationErr.Problems {
+				problems = append(problems, problem.String())
+			}
+			if !reflect.DeepEqual(problems, tc.problems) {
+				t.Errorf("unexpected problems\ngot:      %q\nexpected: %q", problems, tc.problems)
+			}
+		})
+	}
+}
+
+func TestConfigSchemaUpToDate(t *testing.T) {
+	schema, err := ConfigSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published, err := os.ReadFile(filepath.Join("..", "..", "config.schema.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(schema) != string(published) {
+		t.Error("config.schema.json is out of date, run go generate ./...")
+	}
+}
@@ -0,0 +1,228 @@
+package warchangel
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// discoverWARCs returns the WARC files of a job, named by their path relative to their root,
+// in lexical order, along with the directories they were looked for in. A path found under
+// several roots is the file of the first one. The WARCs directory itself must be readable, the
+// other roots and the directories under them are skipped if they can't be read.
+func discoverWARCs(l *slog.Logger, c *Config) (files []PlannedFile, dirs []string, err error) {
+	seen := make(map[string]bool)
+	names := make(map[string]string)
+
+	var walk func(root, dir string) error
+	walk = func(root, dir string) error {
+		if seen[dir] {
+			return nil
+		}
+		seen[dir] = true
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, dir)
+
+		for _, entry := range entries {
+			fullPath := filepath.Join(dir, entry.Name())
+			name, err := filepath.Rel(root, fullPath)
+			if err != nil || isExcluded(c.Exclude, name) {
+				continue
+			}
+
+			if entry.IsDir() {
+				if c.Recursive {
+					if err := walk(root, fullPath); err != nil {
+						l.Error("unable to read directory", "path", fullPath, "err", err)
+					}
+				}
+				continue
+			}
+
+			if !isWARC(entry.Name()) {
+				continue
+			}
+
+			if other, ok := names[name]; ok {
+				if other != root {
+					l.Warn("skipping file already found under another root", "file", name, "root", root, "other", other)
+				}
+				continue
+			}
+			names[name] = root
+
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				l.Error("unable to stat file", "file", name, "err", err)
+				continue
+			}
+
+			files = append(files, PlannedFile{Name: name, Size: info.Size(), modTime: info.ModTime()})
+		}
+
+		return nil
+	}
+
+	if _, err := os.Stat(c.WARCsDir); err != nil {
+		return nil, nil, err
+	}
+
+	for _, root := range c.roots() {
+		for _, dir := range scanDirs(c, root) {
+			if err := walk(root, dir); err != nil {
+				if dir == c.WARCsDir {
+					return nil, nil, err
+				}
+				l.Error("unable to read directory", "path", dir, "err", err)
+			}
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	return files, dirs, nil
+}
+
+// roots returns the directories the files of a job are relative to, WARCsDir first
+func (c *Config) roots() []string {
+	return append([]string{c.WARCsDir}, c.Roots...)
+}
+
+// scanDirs returns the directories a job scans under one of its roots, the root itself or the
+// directories matching its include patterns
+func scanDirs(c *Config, root string) (dirs []string) {
+	if len(c.Include) == 0 {
+		return []string{root}
+	}
+
+	for _, pattern := range c.Include {
+		// Validate rejects the malformed patterns
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+
+		for _, match := range matches {
+			name, err := filepath.Rel(root, match)
+			if err != nil || isExcluded(c.Exclude, name) {
+				continue
+			}
+
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				dirs = append(dirs, match)
+			}
+		}
+	}
+
+	return dirs
+}
+
+// filePath returns the path of a file of the job from its name, under the first root holding
+// it, or under the WARCs directory if none does
+func (c *Config) filePath(name string) string {
+	if len(c.Roots) > 0 {
+		for _, root := range c.roots() {
+			path := filepath.Join(root, name)
+			if _, err := os.Lstat(path); err == nil {
+				return path
+			}
+		}
+	}
+
+	return filepath.Join(c.WARCsDir, name)
+}
+
+// fileName returns the name of the file of the job at path, relative to its root, and whether
+// the job discovers it. A file shadowed by the file of the same name under an earlier root isn't
+// discovered.
+func (c *Config) fileName(path string) (name string, ok bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	for _, root := range c.roots() {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil || !c.tracksFile(name) {
+			continue
+		}
+
+		if resolved, err := filepath.Abs(c.filePath(name)); err != nil || resolved != path {
+			return "", false
+		}
+
+		return name, true
+	}
+
+	return "", false
+}
+
+// tracksFile reports whether name, relative to one of the job's roots, is a WARC file the job
+// discovers, whether it exists or not
+func (c *Config) tracksFile(name string) bool {
+	if !filepath.IsLocal(name) || !isWARC(name) || isExcluded(c.Exclude, name) {
+		return false
+	}
+
+	dir := filepath.ToSlash(filepath.Dir(name))
+
+	if len(c.Include) == 0 {
+		return dir == "." || c.Recursive
+	}
+
+	for _, pattern := range c.Include {
+		pattern = path.Clean(filepath.ToSlash(pattern))
+
+		// With recursive, any directory under a matching one is scanned too
+		for candidate := dir; ; candidate = path.Dir(candidate) {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return true
+			}
+
+			if !c.Recursive || candidate == "." {
+				break
+			}
+		}
+	}
+
+	return false
+}
+
+// isExcluded reports whether name, relative to its root, or one of its parent
+// directories matches one of the patterns. Patterns with a slash are matched against the whole
+// relative path, the others against a single file or directory name.
+func isExcluded(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+
+	name = filepath.ToSlash(name)
+
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+
+		for candidate := name; candidate != "." && candidate != "/"; candidate = path.Dir(candidate) {
+			target := candidate
+			if !strings.Contains(pattern, "/") {
+				target = path.Base(candidate)
+			}
+
+			if matched, _ := path.Match(pattern, target); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+package warchangel
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverWARCs(t *testing.T) {
+	dir := t.TempDir()
+	layout := []string{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz",
+		"WEB-20240109170659538-00002-endgame.local.warc.gz.open",
+		"jobs/crawl/20240101000000/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+		"jobs/crawl/20240102000000/warcs/WEB-20240102000000000-00001-endgame.local.warc.gz",
+		"jobs/crawl/20240102000000/warcs/old/WEB-20231201000000000-00001-endgame.local.warc.gz",
+		"jobs/crawl/20240102000000/logs/WEB-20240102000000000-00001-endgame.local.warc.gz",
+		"shard-1/WEB-20240109170700000-00003-endgame.local.warc.zst",
+	}
+	for _, name := range layout {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		recursive bool
+		include   []string
+		exclude   []string
+		files     []string
+	}{
+		{
+			name:  "top level only",
+			files: []string{"WEB-20240109170659538-00001-endgame.local.warc.gz"},
+		},
+		{
+			name:      "recursive",
+			recursive: true,
+			files: []string{
+				"WEB-20240109170659538-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240101000000/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240102000000/logs/WEB-20240102000000000-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240102000000/warcs/WEB-20240102000000000-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240102000000/warcs/old/WEB-20231201000000000-00001-endgame.local.warc.gz",
+				"shard-1/WEB-20240109170700000-00003-endgame.local.warc.zst",
+			},
+		},
+		{
+			name:    "glob",
+			include: []string{"jobs/*/*/warcs"},
+			files: []string{
+				"jobs/crawl/20240101000000/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240102000000/warcs/WEB-20240102000000000-00001-endgame.local.warc.gz",
+			},
+		},
+		{
+			name:      "several recursive roots with excludes",
+			recursive: true,
+			include:   []string{"jobs/*/*/warcs", "shard-*"},
+			exclude:   []string{"old", "*.zst"},
+			files: []string{
+				"jobs/crawl/20240101000000/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240102000000/warcs/WEB-20240102000000000-00001-endgame.local.warc.gz",
+			},
+		},
+		{
+			name:      "exclude a path",
+			recursive: true,
+			exclude:   []string{"jobs/*/20240102000000", "shard-1"},
+			files: []string{
+				"WEB-20240109170659538-00001-endgame.local.warc.gz",
+				"jobs/crawl/20240101000000/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Config{WARCsDir: dir, Recursive: tc.recursive, Include: tc.include, Exclude: tc.exclude}
+
+			files, _, err := discoverWARCs(slog.New(slog.NewTextHandler(io.Discard, nil)), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, file := range files {
+				names = append(names, filepath.ToSlash(file.Name))
+			}
+			if !reflect.DeepEqual(names, tc.files) {
+				t.Errorf("unexpected files\ngot:      %q\nexpected: %q", names, tc.files)
+			}
+
+			// The notifications and the submissions accept the same files as the scans
+			discovered := make(map[string]bool)
+			for _, name := range names {
+				discovered[name] = true
+			}
+			for _, name := range layout {
+				if c.tracksFile(filepath.FromSlash(name)) != discovered[name] {
+					t.Errorf("expected tracksFile(%s) to be %t", name, discovered[name])
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoverWARCsRoots(t *testing.T) {
+	warcs, heritrix, zeno := t.TempDir(), t.TempDir(), t.TempDir()
+	layout := map[string][]string{
+		warcs: {"WEB-20240109170659538-00001-endgame.local.warc.gz"},
+		heritrix: {
+			"jobs/crawl/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+			// Shadowed by the file of the same path in the WARCs directory
+			"WEB-20240109170659538-00001-endgame.local.warc.gz",
+		},
+		zeno: {"WEB-20240109170700000-00002-endgame.local.warc.gz"},
+	}
+	for root, names := range layout {
+		for _, name := range names {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := &Config{WARCsDir: warcs, Roots: []string{heritrix, zeno, filepath.Join(t.TempDir(), "missing")}, Recursive: true}
+
+	files, _, err := discoverWARCs(slog.New(slog.NewTextHandler(io.Discard, nil)), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.ToSlash(file.Name))
+	}
+	expected := []string{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz",
+		"WEB-20240109170700000-00002-endgame.local.warc.gz",
+		"jobs/crawl/warcs/WEB-20240101000000000-00001-endgame.local.warc.gz",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected files\ngot:      %q\nexpected: %q", names, expected)
+	}
+
+	// Files are found back under their root from their name, and the other way around
+	paths := map[string]string{
+		expected[0]: filepath.Join(warcs, expected[0]),
+		expected[1]: filepath.Join(zeno, expected[1]),
+		expected[2]: filepath.Join(heritrix, filepath.FromSlash(expected[2])),
+	}
+	for name, path := range paths {
+		if got := c.filePath(filepath.FromSlash(name)); got != path {
+			t.Errorf("expected %s to be at %s, got %s", name, path, got)
+		}
+		if got, ok := c.fileName(path); !ok || filepath.ToSlash(got) != name {
+			t.Errorf("expected %s to be named %s, got %s", path, name, got)
+		}
+	}
+
+	if name, ok := c.fileName(filepath.Join(heritrix, expected[0])); ok {
+		t.Errorf("expected the shadowed file not to be tracked, got %s", name)
+	}
+}
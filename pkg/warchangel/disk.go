@@ -0,0 +1,271 @@
+package warchangel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCheckInterval is how often the jobs with a disk high-water mark check the
+// usage of the filesystem holding their WARCs directory
+const diskCheckInterval = 10 * time.Second
+
+// diskVerifyInterval is how often a job under disk pressure verifies its uploaded files
+// with archive.org, so that they can be deleted
+const diskVerifyInterval = 5 * time.Minute
+
+// diskLowWater returns the disk usage, in percent, under which the job leaves the disk pressure mode
+func (c *Config) diskLowWater() int {
+	if c.DiskLowWater > 0 {
+		return c.DiskLowWater
+	}
+
+	return max(c.DiskHighWater-5, 0)
+}
+
+// diskPressureThreads returns the number of parallel uploads of the job under disk pressure
+func (c *Config) diskPressureThreads() int {
+	if c.DiskPressureThreads > 0 {
+		return c.DiskPressureThreads
+	}
+
+	return 2 * c.Threads
+}
+
+// pauseFilePath returns the path of the pause marker file, if the job has one
+func (c *Config) pauseFilePath() string {
+	if c.PauseFile == "" || filepath.IsAbs(c.PauseFile) {
+		return c.PauseFile
+	}
+
+	return filepath.Join(c.WARCsDir, c.PauseFile)
+}
+
+// checkDisk compares the usage of the filesystem holding the WARCs directory with
+// the job's water marks, and enters or leaves the disk pressure mode accordingly
+func (j *job) checkDisk() {
+	c := j.currentConfig()
+
+	if c.DiskHighWater == 0 {
+		j.setDiskPressure(false, "disk usage isn't monitored anymore")
+		return
+	}
+
+	total, free, err := j.u.diskUsage(c.WARCsDir)
+	if err == nil && total == 0 {
+		err = errors.New("empty filesystem")
+	}
+	if err != nil {
+		if j.diskErr != err.Error() {
+			j.diskErr = err.Error()
+			j.logger.Warn("unable to check disk usage", "path", c.WARCsDir, "err", err)
+		}
+		return
+	}
+	j.diskErr = ""
+
+	used := float64(total-free) / float64(total) * 100
+
+	j.mu.RLock()
+	pressure := j.diskPressure
+	j.mu.RUnlock()
+
+	switch {
+	case !pressure && used >= float64(c.DiskHighWater):
+		message := fmt.Sprintf("disk usage %.1f%% reached the high-water mark of %d%%, %d bytes free", used, c.DiskHighWater, free)
+		if deletable, files := j.deletable(c, FileVerified); files > 0 {
+			message += fmt.Sprintf(", %d verified files totaling %d bytes can be deleted", files, deletable)
+		}
+		if unverified, files := j.deletable(c, FileUploaded); files > 0 {
+			message += fmt.Sprintf(", %d more uploaded files totaling %d bytes once verified", files, unverified)
+		}
+		j.setDiskPressure(true, message)
+		j.verifyUploaded(c)
+	case pressure && used < float64(c.diskLowWater()):
+		j.setDiskPressure(false, fmt.Sprintf("disk usage %.1f%% went under the low-water mark of %d%%", used, c.diskLowWater()))
+	case pressure:
+		j.verifyUploaded(c)
+	}
+}
+
+// verifyUploaded compares the uploaded files still on disk with their copy on archive.org in
+// the background, at most every diskVerifyInterval, and alerts with the files that can be
+// deleted once they are verified. Verifying comes first under disk pressure, as it makes
+// space deletable without waiting for the uploads.
+func (j *job) verifyUploaded(c *Config) {
+	if j.state == nil || time.Since(j.lastVerify) < diskVerifyInterval || !j.verifying.CompareAndSwap(false, true) {
+		return
+	}
+	j.lastVerify = time.Now()
+
+	var names []string
+	err := j.state.View(func(st *State) {
+		for _, name := range st.FilesWithStatus(FileUploaded) {
+			if _, err := os.Lstat(c.filePath(name)); err == nil {
+				names = append(names, name)
+			}
+		}
+	})
+	if err != nil || len(names) == 0 {
+		j.verifying.Store(false)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j.verifier.Add(1)
+	go func() {
+		defer j.verifier.Done()
+		defer j.verifying.Store(false)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-j.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		results, err := j.u.verify(ctx, c, j.logger, j.state, names)
+		if err != nil {
+			j.logger.Error("unable to verify the uploaded files under disk pressure", "err", err)
+			return
+		}
+
+		var verified int
+		for _, result := range results {
+			if result.Verified {
+				verified++
+			}
+		}
+		if verified == 0 {
+			return
+		}
+
+		deletable, files := j.deletable(c, FileVerified)
+		message := fmt.Sprintf("%d uploaded files were verified, %d verified files totaling %d bytes can be deleted", verified, files, deletable)
+		j.logger.Warn("disk pressure, files can be deleted", "reason", message)
+		j.u.alert(Alert{Job: c.Job, Kind: AlertDiskDeletable, Message: message})
+	}()
+}
+
+// setDiskPressure enters or leaves the disk pressure mode: while under pressure, the job uploads
+// more files in parallel, the largest first so that each upload makes the most space deletable,
+// and the pause marker file tells the crawler to slow down
+func (j *job) setDiskPressure(pressure bool, message string) {
+	j.mu.Lock()
+	if j.diskPressure == pressure {
+		j.mu.Unlock()
+		return
+	}
+
+	j.diskPressure = pressure
+	j.applyLimits()
+	c := j.config
+	j.mu.Unlock()
+
+	if pressure {
+		j.logger.Error("disk pressure, draining the WARCs directory", "reason", message, "threads", j.pool.Size())
+		j.u.diskPressure(1)
+		j.u.alert(Alert{Job: c.Job, Kind: AlertDiskPressure, Message: message})
+		j.writePauseFile(c, message)
+		return
+	}
+
+	j.logger.Info("disk pressure relieved", "reason", message, "threads", j.pool.Size())
+	j.u.diskPressure(-1)
+	j.u.alert(Alert{Job: c.Job, Kind: AlertDiskRecovered, Message: message})
+	j.removePauseFile()
+}
+
+// stopDiskPressure removes the pause marker file once the job stopped, as nothing drains the
+// WARCs directory anymore
+func (j *job) stopDiskPressure() {
+	j.mu.RLock()
+	pressure := j.diskPressure
+	j.mu.RUnlock()
+
+	if pressure {
+		j.u.diskPressure(-1)
+		j.removePauseFile()
+	}
+}
+
+// applyLimits sets the upload concurrency and order of the job from its configuration, or from
+// its disk pressure settings while under pressure, the concurrency being adjusted in adaptive mode,
+// and its bandwidth limit. j.mu must be held.
+func (j *job) applyLimits() {
+	// Checked by Validate
+	timetable, _ := parseBandwidthLimit(j.config.BandwidthLimit)
+	j.bandwidth.setTimetable(timetable)
+
+	if j.diskPressure {
+		j.pool.SetSize(j.config.diskPressureThreads())
+		j.pending.setOrder(OrderLargest)
+		return
+	}
+
+	threads := j.config.Threads
+	if j.config.AdaptiveThreads {
+		threads = j.concurrency.current(j.config)
+	}
+
+	j.pool.SetSize(threads)
+	j.pending.setOrder(j.config.Order)
+}
+
+// deletable returns the size and number of the files with one of the statuses that are still
+// on disk, verified files being the space that can be reclaimed right away
+func (j *job) deletable(c *Config, statuses ...FileStatus) (size int64, files int) {
+	if j.state == nil {
+		return 0, 0
+	}
+
+	var names []string
+	if err := j.state.View(func(st *State) {
+		names = st.FilesWithStatus(statuses...)
+	}); err != nil {
+		return 0, 0
+	}
+
+	for _, name := range names {
+		if info, err := os.Stat(c.filePath(name)); err == nil {
+			size += info.Size()
+			files++
+		}
+	}
+
+	return size, files
+}
+
+// writePauseFile creates the pause marker file the crawler wrappers watch, if the job has one
+func (j *job) writePauseFile(c *Config, message string) {
+	path := c.pauseFilePath()
+	if path == "" {
+		return
+	}
+
+	if err := os.WriteFile(path, []byte(message+"\n"), 0o644); err != nil {
+		j.logger.Error("unable to write pause file", "path", path, "err", err)
+		return
+	}
+
+	j.pauseFile = path
+}
+
+// removePauseFile removes the pause marker file written by writePauseFile, if any
+func (j *job) removePauseFile() {
+	if j.pauseFile == "" {
+		return
+	}
+
+	if err := os.Remove(j.pauseFile); err != nil && !os.IsNotExist(err) {
+		j.logger.Error("unable to remove pause file", "path", j.pauseFile, "err", err)
+		return
+	}
+
+	j.pauseFile = ""
+}
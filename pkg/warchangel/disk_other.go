@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package warchangel
+
+import "errors"
+
+// statDiskUsage isn't available on this platform, disk pressure can't be detected
+func statDiskUsage(path string) (total, free uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
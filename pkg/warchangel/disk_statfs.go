@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package warchangel
+
+import "golang.org/x/sys/unix"
+
+// statDiskUsage returns the size of the filesystem holding path, and the space
+// available to unprivileged users on it, in bytes
+func statDiskUsage(path string) (total, free uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(st.Blocks) * uint64(st.Bsize), uint64(st.Bavail) * uint64(st.Bsize), nil
+}
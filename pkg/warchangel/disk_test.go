@@ -0,0 +1,120 @@
+package warchangel
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJobDiskPressure(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.Threads = 2
+	c.DiskHighWater = 90
+	c.DiskLowWater = 80
+	c.PauseFile = ".pause"
+	writeWARCs(t, c.WARCsDir, map[string]int{"WEB-20240109170659538-00001-endgame.local.warc.gz": 600})
+
+	store := NewStateStore(DefaultStatePath(c))
+	if err := store.Update(func(st *State) bool {
+		st.SetFile("WEB-20240109170659538-00001-endgame.local.warc.gz", FileUploaded, nil)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var alerts []Alert
+	u := newUploader(Options{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		OnAlert: func(a Alert) { alerts = append(alerts, a) },
+	})
+
+	var used uint64
+	u.diskUsage = func(path string) (total, free uint64, err error) {
+		return 100, 100 - used, nil
+	}
+
+	// Verifying the uploaded file under pressure finds it on archive.org
+	var verified []string
+	u.verify = func(ctx context.Context, c *Config, l *slog.Logger, store *StateStore, files []string) ([]VerifyResult, error) {
+		verified = append(verified, files...)
+		err := store.Update(func(st *State) bool {
+			for _, name := range files {
+				st.SetFile(name, FileVerified, nil)
+			}
+			return true
+		})
+
+		return []VerifyResult{{File: files[0], Verified: true}}, err
+	}
+
+	j := u.newJob(c, store)
+	pauseFile := filepath.Join(c.WARCsDir, ".pause")
+
+	steps := []struct {
+		used     uint64
+		pressure bool
+		threads  int
+		order    UploadOrder
+		alerts   int
+	}{
+		{used: 50, threads: 2, order: ""},
+		{used: 95, pressure: true, threads: 4, order: OrderLargest, alerts: 2},
+		// Between the water marks, the job stays under pressure
+		{used: 85, pressure: true, threads: 4, order: OrderLargest, alerts: 2},
+		{used: 70, threads: 2, order: "", alerts: 3},
+	}
+
+	for i, step := range steps {
+		used = step.used
+		j.checkDisk()
+		j.verifier.Wait()
+
+		if j.diskPressure != step.pressure {
+			t.Fatalf("step %d: expected disk pressure to be %t", i, step.pressure)
+		}
+		if j.pool.Size() != step.threads {
+			t.Errorf("step %d: expected %d upload threads, got %d", i, step.threads, j.pool.Size())
+		}
+		if j.pending.files.order != step.order {
+			t.Errorf("step %d: expected the %q upload order, got %q", i, step.order, j.pending.files.order)
+		}
+		if len(alerts) != step.alerts {
+			t.Fatalf("step %d: expected %d alerts, got %+v", i, step.alerts, alerts)
+		}
+		if _, err := os.Stat(pauseFile); (err == nil) != step.pressure {
+			t.Errorf("step %d: expected the pause file to exist only under pressure, got %v", i, err)
+		}
+		if stats := u.Stats(); stats.DiskPressure != map[bool]int{true: 1}[step.pressure] {
+			t.Errorf("step %d: unexpected stats %+v", i, stats)
+		}
+	}
+
+	if alerts[0].Kind != AlertDiskPressure || alerts[0].Job != "test" || !strings.Contains(alerts[0].Message, "1 more uploaded files totaling 600 bytes once verified") {
+		t.Errorf("unexpected alert %+v", alerts[0])
+	}
+	if alerts[1].Kind != AlertDiskDeletable || !strings.Contains(alerts[1].Message, "1 verified files totaling 600 bytes can be deleted") {
+		t.Errorf("unexpected alert %+v", alerts[1])
+	}
+	if alerts[2].Kind != AlertDiskRecovered {
+		t.Errorf("unexpected alert %+v", alerts[2])
+	}
+	if len(verified) != 1 {
+		t.Errorf("expected the uploaded file to be verified once under pressure, got %v", verified)
+	}
+
+	// A reload while under pressure keeps the pressure settings
+	used = 95
+	j.checkDisk()
+	next := *c
+	next.Threads = 3
+	if _, err := j.reload(&next); err != nil {
+		t.Fatal(err)
+	}
+	if j.pool.Size() != 6 {
+		t.Errorf("expected twice the new threads under pressure, got %d", j.pool.Size())
+	}
+}
@@ -0,0 +1,205 @@
+package warchangel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Marker files Draintasker writes in a pack directory as the pack goes through its pipeline
+const (
+	draintaskerManifest  = "MANIFEST"
+	draintaskerPacked    = "PACKED"
+	draintaskerLaunch    = "LAUNCH"
+	draintaskerTask      = "TASK"
+	draintaskerTombstone = "TOMBSTONE"
+)
+
+// DraintaskerPack is a Draintasker pack directory, named after its item, and what was imported from it
+type DraintaskerPack struct {
+	Item string `json:"item"`
+	// Status is the status given to the pack's files
+	Status FileStatus `json:"status"`
+	Files  []string   `json:"files"`
+	// Skipped are the files warchangel already knew about, their state is left untouched
+	Skipped []string `json:"skipped,omitempty"`
+	// Moved are the WARC files moved from the pack directory back into the WARCs directory
+	Moved []string `json:"moved,omitempty"`
+}
+
+// ImportDraintaskerPacks reads the pack directories Draintasker left in its transfer
+// directory (xfer_dir) into the state, so that a job can be switched over to warchangel:
+//   - files of packs with a TOMBSTONE are recorded as verified
+//   - files of packs with a TASK are recorded as uploaded
+//   - files of packs that haven't been uploaded yet (MANIFEST, PACKED or LAUNCH) are queued
+//     into the pack's item and moved back into the WARCs directory, so that warchangel
+//     finishes the item under its original identifier
+func ImportDraintaskerPacks(c *Config, l *slog.Logger, store *StateStore, xferDir string) ([]*DraintaskerPack, error) {
+	entries, err := os.ReadDir(xferDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type packFile struct {
+		name string
+		size int64
+		md5  string
+	}
+
+	var (
+		packs []*DraintaskerPack
+		files = make(map[*DraintaskerPack][]packFile)
+	)
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(xferDir, entry.Name())
+		pack := &DraintaskerPack{Item: entry.Name()}
+
+		switch {
+		case exists(filepath.Join(dir, draintaskerTombstone)):
+			pack.Status = FileVerified
+		case exists(filepath.Join(dir, draintaskerTask)):
+			pack.Status = FileUploaded
+		case exists(filepath.Join(dir, draintaskerLaunch)),
+			exists(filepath.Join(dir, draintaskerPacked)),
+			exists(filepath.Join(dir, draintaskerManifest)):
+			pack.Status = FileQueued
+		default:
+			l.Debug("skipping directory without Draintasker markers", "path", dir)
+			continue
+		}
+
+		checksums, err := readDraintaskerManifest(filepath.Join(dir, draintaskerManifest))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifest of pack %s: %w", pack.Item, err)
+		}
+
+		// Without a manifest, the pack is whatever WARC files are in its directory
+		if checksums == nil {
+			warcs, err := listWARCs(l, dir)
+			if err != nil {
+				return nil, err
+			}
+
+			checksums = make(map[string]string)
+			for _, warc := range warcs {
+				checksums[warc.Name] = ""
+			}
+		}
+
+		for name, md5sum := range checksums {
+			file := packFile{name: name, md5: md5sum}
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				file.size = info.Size()
+			}
+
+			files[pack] = append(files[pack], file)
+		}
+
+		sort.Slice(files[pack], func(i, j int) bool {
+			return files[pack][i].name < files[pack][j].name
+		})
+
+		packs = append(packs, pack)
+	}
+
+	err = store.Update(func(st *State) bool {
+		for _, pack := range packs {
+			for _, file := range files[pack] {
+				if _, ok := st.Files[file.name]; ok {
+					pack.Skipped = append(pack.Skipped, file.name)
+					continue
+				}
+
+				f := st.SetFile(file.name, pack.Status, nil)
+				f.Item = pack.Item
+				f.Size = file.size
+				f.MD5 = file.md5
+
+				item, ok := st.Items[pack.Item]
+				if !ok {
+					item = &ItemState{CreatedAt: time.Now()}
+					st.Items[pack.Item] = item
+				}
+				item.Size += file.size
+				item.Files++
+
+				pack.Files = append(pack.Files, file.name)
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Move the files of unfinished packs where the watcher will find them
+	for _, pack := range packs {
+		if pack.Status != FileQueued {
+			continue
+		}
+
+		for _, name := range pack.Files {
+			src := filepath.Join(xferDir, pack.Item, name)
+			dst := filepath.Join(c.WARCsDir, name)
+
+			if !exists(src) || exists(dst) {
+				continue
+			}
+
+			if err := os.Rename(src, dst); err != nil {
+				return packs, fmt.Errorf("unable to move %s back to the WARCs directory: %w", src, err)
+			}
+
+			pack.Moved = append(pack.Moved, name)
+		}
+	}
+
+	return packs, nil
+}
+
+// readDraintaskerManifest reads a MANIFEST file made of md5sum lines and returns
+// the checksums indexed by filename, or nil if the manifest doesn't exist
+func readDraintaskerManifest(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checksums := make(map[string]string)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		// md5sum prefixes the filename with * in binary mode
+		name := filepath.Base(strings.TrimPrefix(fields[len(fields)-1], "*"))
+		if isWARC(name) {
+			checksums[name] = fields[0]
+		}
+	}
+
+	return checksums, scanner.Err()
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
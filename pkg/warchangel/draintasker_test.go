@@ -0,0 +1,125 @@
+package warchangel
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportDraintaskerPacks(t *testing.T) {
+	var (
+		warcsDir = t.TempDir()
+		xferDir  = t.TempDir()
+	)
+
+	packs := map[string]map[string]string{
+		// Uploaded and verified, the WARCs were deleted
+		"WIDE-20240101000000-crawl1": {
+			"MANIFEST":  "d41d8cd98f00b204e9800998ecf8427e  WIDE-20240101000000000-00001-1~crawl1.archive.org~6440.warc.gz\n",
+			"PACKED":    "",
+			"LAUNCH":    "",
+			"TASK":      "",
+			"TOMBSTONE": "",
+		},
+		// Uploaded, waiting for verification
+		"WIDE-20240102000000-crawl1": {
+			"MANIFEST": "d41d8cd98f00b204e9800998ecf8427e *WIDE-20240102000000000-00002-1~crawl1.archive.org~6440.warc.gz\n",
+			"TASK":     "",
+			"WIDE-20240102000000000-00002-1~crawl1.archive.org~6440.warc.gz": "",
+		},
+		// Packed but never uploaded
+		"WIDE-20240103000000-crawl1": {
+			"PACKED": "",
+			"WIDE-20240103000000000-00003-1~crawl1.archive.org~6440.warc.gz": "warc",
+			"WIDE-20240103000100000-00004-1~crawl1.archive.org~6440.warc.gz": "warc",
+		},
+		// Not a pack
+		"lost+found": {},
+	}
+
+	for pack, files := range packs {
+		dir := filepath.Join(xferDir, pack)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := &Config{WARCsDir: warcsDir, WARCNaming: HeritrixWARCNaming}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := NewStateStore(DefaultStatePath(c))
+
+	imported, err := ImportDraintaskerPacks(c, l, store, xferDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 3 {
+		t.Fatalf("expected 3 packs to be imported, got %d", len(imported))
+	}
+
+	st, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct {
+		item   string
+		status FileStatus
+	}{
+		"WIDE-20240101000000000-00001-1~crawl1.archive.org~6440.warc.gz": {"WIDE-20240101000000-crawl1", FileVerified},
+		"WIDE-20240102000000000-00002-1~crawl1.archive.org~6440.warc.gz": {"WIDE-20240102000000-crawl1", FileUploaded},
+		"WIDE-20240103000000000-00003-1~crawl1.archive.org~6440.warc.gz": {"WIDE-20240103000000-crawl1", FileQueued},
+		"WIDE-20240103000100000-00004-1~crawl1.archive.org~6440.warc.gz": {"WIDE-20240103000000-crawl1", FileQueued},
+	}
+
+	for name, e := range expected {
+		f, ok := st.Files[name]
+		if !ok {
+			t.Errorf("expected %s to be imported", name)
+			continue
+		}
+		if f.Item != e.item || f.Status != e.status {
+			t.Errorf("expected %s to be %s in %s, got %s in %s", name, e.status, e.item, f.Status, f.Item)
+		}
+	}
+
+	if st.Files["WIDE-20240101000000000-00001-1~crawl1.archive.org~6440.warc.gz"].MD5 != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Error("expected the checksum from the manifest to be imported")
+	}
+
+	// The unfinished pack's WARCs are moved back and continue in their original item
+	files, err := listWARCs(l, warcsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the 2 WARCs of the unfinished pack to be moved back, got %+v", files)
+	}
+
+	packer := newItemPacker(c, st, l)
+	item, err := packer.assign(files[0].Name, files[0].Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != "WIDE-20240103000000-crawl1" {
+		t.Errorf("expected the unfinished pack to keep its identifier, got %s", item)
+	}
+
+	// Importing again doesn't touch the files warchangel already knows about
+	imported, err = ImportDraintaskerPacks(c, l, store, xferDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pack := range imported {
+		if len(pack.Files) != 0 {
+			t.Errorf("expected pack %s to be skipped on the second import, got %v", pack.Item, pack.Files)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package warchangel
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// DryRunReport is what a single pass of the watcher would have uploaded
+type DryRunReport struct {
+	Job   string        `json:"job"`
+	Items []*DryRunItem `json:"items"`
+	// State is the summary of the state the pass would have left, including the files that failed
+	State *StateSummary `json:"state"`
+}
+
+// DryRun runs a single pass of the whole pipeline (scanning, parsing, integrity checks,
+// packing and metadata generation) without uploading anything. It starts from the job's
+// state but works on a copy of it, so the real state is left untouched.
+func DryRun(c *Config, l *slog.Logger) (*DryRunReport, error) {
+	dryRun := &dryRunBackend{logger: l}
+
+	u := newUploader(Options{Logger: l, Backend: dryRun})
+
+	current, err := NewStateStore(DefaultStatePath(c)).Load()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "warchangel-dry-run")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	j := u.newJob(c, NewStateStore(filepath.Join(dir, "state.json")))
+	if err := j.state.Update(func(st *State) bool {
+		*st = *current
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	l.Info("starting dry-run", "path", c.WARCsDir)
+
+	j.scan()
+	j.startQueued()
+	j.pool.Wait()
+
+	st, err := j.state.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DryRunReport{
+		Job:   c.Job,
+		Items: dryRun.items,
+		State: st.Summary(),
+	}, nil
+}
@@ -0,0 +1,95 @@
+package warchangel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+
+	good := gzipData(t, "WARC/1.1\r\n")
+	files := map[string][]byte{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": good,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": good[:len(good)-4],
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Config{
+		WARCsDir:          dir,
+		WARCNaming:        ZenoWARCNaming,
+		ItemSize:          1,
+		Collections:       []string{"a", "b"},
+		TitlePrefix:       "Test crawl",
+		VerifyCompression: true,
+		MD5:               true,
+		Threads:           2,
+	}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := DryRun(c, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Items) != 1 || len(report.Items[0].Files) != 1 {
+		t.Fatalf("expected a single item with the valid WARC, got %+v", report.Items)
+	}
+
+	item := report.Items[0]
+	if item.Identifier != "WEB-20240109170659-endgame" {
+		t.Errorf("unexpected item identifier %s", item.Identifier)
+	}
+
+	file := item.Files[0]
+	if file.MD5 == "" {
+		t.Error("expected the MD5 checksum to be computed")
+	}
+
+	expected := map[string]string{
+		"x-archive-meta01-collection": "a",
+		"x-archive-meta02-collection": "b",
+		"x-archive-meta-title":        "Test crawl",
+		"x-archive-meta-crawler":      "Zeno",
+		"x-archive-meta-scanner":      "endgame.local",
+		"x-archive-meta-date":         "2024",
+	}
+	for header, value := range expected {
+		if file.Headers[header] != value {
+			t.Errorf("expected header %s to be %q, got %q", header, value, file.Headers[header])
+		}
+	}
+
+	if len(report.State.Failed) != 1 {
+		t.Errorf("expected the truncated WARC to fail its integrity check, got %+v", report.State.Failed)
+	}
+
+	// The real state must be left untouched
+	if _, err := os.Stat(DefaultStatePath(c)); !os.IsNotExist(err) {
+		t.Errorf("expected dry-run not to write the job's state, got %v", err)
+	}
+}
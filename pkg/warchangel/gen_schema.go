@@ -0,0 +1,23 @@
+//go:build ignore
+
+// gen_schema writes the JSON Schema of the warchangel configuration
+// to config.schema.json at the root of the repository.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+func main() {
+	schema, err := warchangel.ConfigSchema()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile("../../config.schema.json", schema, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,441 @@
+package warchangel
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPartSize is the size of the parts of the multipart uploads, smaller files are sent in a single request
+const defaultPartSize = 1 << 30
+
+// iaS3AbortTimeout is how long aborting a failed multipart upload can take
+const iaS3AbortTimeout = 30 * time.Second
+
+// iaS3Backend uploads files with IA S3, archive.org's S3-like API. Its HTTP client, and so its
+// connections, are shared by every upload.
+type iaS3Backend struct {
+	accessKey string
+	secretKey string
+	// endpoint and frontEndpoint are IA S3 and archive.org, defaultS3Endpoint and defaultFrontEndpoint if empty
+	endpoint      string
+	frontEndpoint string
+	client        *http.Client
+	// partSize is the size of the parts of the multipart uploads, defaultPartSize if 0
+	partSize int64
+}
+
+// NewIAS3Backend returns the default Backend, which sends the files to IA S3 with the given credentials
+func NewIAS3Backend(accessKey, secretKey string) Backend {
+	return newIAS3Backend(accessKey, secretKey)
+}
+
+func newIAS3Backend(accessKey, secretKey string) *iaS3Backend {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+
+	return &iaS3Backend{accessKey: accessKey, secretKey: secretKey, client: &http.Client{Transport: transport}}
+}
+
+// iaS3Error is an error response of IA S3
+type iaS3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *iaS3Error) Error() string {
+	message := fmt.Sprintf("IA S3 error %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		message += ": " + e.Code
+	}
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+
+	return message
+}
+
+// Unwrap returns ErrSlowDown when archive.org asked to slow down
+func (e *iaS3Error) Unwrap() error {
+	if e.Code == "SlowDown" || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable {
+		return ErrSlowDown
+	}
+
+	return nil
+}
+
+func (b *iaS3Backend) Put(ctx context.Context, upload *Upload) (remote string, err error) {
+	partSize := b.partSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+
+	if upload.Size > partSize {
+		err = b.putMultipart(ctx, upload, partSize)
+	} else {
+		err = b.putSingle(ctx, upload)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return upload.Item + "/" + upload.Filename, nil
+}
+
+// putSingle sends the file in a single request
+func (b *iaS3Backend) putSingle(ctx context.Context, upload *Upload) error {
+	sum := md5.New()
+	req, err := b.request(ctx, http.MethodPut, upload, "", io.TeeReader(upload.Body, sum))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = upload.Size
+	b.setItemHeaders(req, upload)
+	if upload.MD5 != "" {
+		// IA S3 checks the file it received against it
+		req.Header.Set("Content-MD5", upload.MD5)
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return verifyChecksum(upload.MD5, sum, resp.Header.Get("ETag"))
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// putMultipart sends the file in parts of partSize, the multipart upload is aborted if one fails
+func (b *iaS3Backend) putMultipart(ctx context.Context, upload *Upload, partSize int64) (err error) {
+	req, err := b.request(ctx, http.MethodPost, upload, "uploads", nil)
+	if err != nil {
+		return err
+	}
+	b.setItemHeaders(req, upload)
+
+	var initiated initiateMultipartUploadResult
+	if err := b.doXML(req, &initiated); err != nil {
+		return fmt.Errorf("unable to initiate multipart upload: %w", err)
+	}
+	uploadID := "uploadId=" + url.QueryEscape(initiated.UploadID)
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// Let IA S3 drop the parts sent so far, even if the upload was cancelled
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), iaS3AbortTimeout)
+		defer cancel()
+
+		req, abortErr := b.request(abortCtx, http.MethodDelete, upload, uploadID, nil)
+		if abortErr == nil {
+			var resp *http.Response
+			if resp, abortErr = b.do(req); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+		if abortErr != nil {
+			err = fmt.Errorf("%w (unable to abort multipart upload: %v)", err, abortErr)
+		}
+	}()
+
+	var (
+		parts []completedPart
+		whole = md5.New()
+	)
+	for number, offset := 1, int64(0); offset < upload.Size; number, offset = number+1, offset+partSize {
+		size := min(partSize, upload.Size-offset)
+		sum := md5.New()
+		body := io.TeeReader(io.LimitReader(upload.Body, size), io.MultiWriter(sum, whole))
+
+		req, err := b.request(ctx, http.MethodPut, upload, "partNumber="+strconv.Itoa(number)+"&"+uploadID, body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+
+		resp, err := b.do(req)
+		if err != nil {
+			return fmt.Errorf("unable to upload part %d: %w", number, err)
+		}
+		resp.Body.Close()
+
+		etag := resp.Header.Get("ETag")
+		if err := verifyChecksum("", sum, etag); err != nil {
+			return fmt.Errorf("part %d: %w", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+	}
+
+	// The parts only tell whether each one was received intact, the whole file is checked here
+	if err := verifyChecksum(upload.MD5, whole, ""); err != nil {
+		return err
+	}
+
+	completion, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	req, err = b.request(ctx, http.MethodPost, upload, uploadID, bytes.NewReader(completion))
+	if err != nil {
+		return err
+	}
+
+	// IA S3 can report an error with a 200 once it started answering
+	var completed struct {
+		iaS3Error
+		XMLName xml.Name
+	}
+	if err := b.doXML(req, &completed); err != nil {
+		return fmt.Errorf("unable to complete multipart upload: %w", err)
+	}
+	if completed.XMLName.Local == "Error" {
+		completed.StatusCode = http.StatusOK
+		return fmt.Errorf("unable to complete multipart upload: %w", &completed.iaS3Error)
+	}
+
+	return nil
+}
+
+// request returns an authenticated request on the upload's file, with the given raw query
+func (b *iaS3Backend) request(ctx context.Context, method string, upload *Upload, query string, body io.Reader) (*http.Request, error) {
+	endpoint := b.endpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
+	target := endpoint + "/" + url.PathEscape(upload.Item) + "/" + url.PathEscape(upload.Filename)
+	if query != "" {
+		target += "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("LOW %s:%s", b.accessKey, b.secretKey))
+
+	return req, nil
+}
+
+// setItemHeaders sets the headers creating the upload's item if it doesn't exist yet, with its metadata
+func (b *iaS3Backend) setItemHeaders(req *http.Request, upload *Upload) {
+	req.Header.Set("x-archive-auto-make-bucket", "1")
+	req.Header.Set("x-archive-size-hint", strconv.FormatInt(upload.Size, 10))
+	if upload.Derive {
+		req.Header.Set("x-archive-queue-derive", "1")
+	} else {
+		req.Header.Set("x-archive-queue-derive", "0")
+	}
+
+	for name, value := range upload.Metadata.Headers() {
+		req.Header.Set(name, value)
+	}
+}
+
+// do sends the request, turning the error responses into *iaS3Error
+func (b *iaS3Backend) do(req *http.Request) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	iaErr := &iaS3Error{StatusCode: resp.StatusCode}
+	if body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); err == nil {
+		// The error is only described by its status code if the body isn't S3's XML
+		_ = xml.Unmarshal(body, iaErr)
+	}
+
+	return nil, iaErr
+}
+
+// doXML sends the request and decodes its XML response into v
+func (b *iaS3Backend) doXML(req *http.Request, v any) error {
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid IA S3 response: %w", err)
+	}
+
+	return nil
+}
+
+// verifyChecksum checks that the bytes summed by sum are the expected ones, if known, and the ones
+// IA S3 received according to its etag, if it's an MD5 checksum
+func verifyChecksum(expected string, sum hash.Hash, etag string) error {
+	sent := hex.EncodeToString(sum.Sum(nil))
+
+	if expected != "" && !strings.EqualFold(expected, sent) {
+		return fmt.Errorf("the file changed while it was sent, MD5 %s instead of %s", sent, expected)
+	}
+
+	if received := strings.Trim(etag, `"`); len(received) == md5.Size*2 && !strings.EqualFold(received, sent) {
+		return errors.New("IA S3 received a corrupted file, MD5 " + received + " instead of " + sent)
+	}
+
+	return nil
+}
+
+// UpdateMetadata adds the values of metadata to the metadata of an existing item with archive.org's
+// metadata API, keeping the values the item already has
+func (b *iaS3Backend) UpdateMetadata(ctx context.Context, item string, metadata ItemMetadata) error {
+	endpoint := b.frontEndpoint
+	if endpoint == "" {
+		endpoint = defaultFrontEndpoint
+	}
+	target := endpoint + "/metadata/" + url.PathEscape(item)
+
+	current, err := b.itemMetadata(ctx, target)
+	if err != nil {
+		return fmt.Errorf("unable to fetch metadata of item %s: %w", item, err)
+	}
+
+	type operation struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}
+
+	var patch []operation
+	for _, key := range metadata.keys() {
+		name := strings.ToLower(key)
+		values := current[name]
+		changed := false
+		for _, value := range metadata[key] {
+			if !slices.Contains(values, value) {
+				values = append(values, value)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		var value any = values
+		if len(values) == 1 {
+			value = values[0]
+		}
+		patch = append(patch, operation{Op: "add", Path: "/" + name, Value: value})
+	}
+
+	if len(patch) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"-target": {"metadata"},
+		"-patch":  {string(encoded)},
+		"access":  {b.accessKey},
+		"secret":  {b.secretKey},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return fmt.Errorf("unable to update metadata of item %s: %s", item, resp.Status)
+	}
+	if !result.Success {
+		return fmt.Errorf("unable to update metadata of item %s: %s", item, result.Error)
+	}
+
+	return nil
+}
+
+// itemMetadata returns the metadata of an item, each field with its values
+func (b *iaS3Backend) itemMetadata(ctx context.Context, target string) (map[string][]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target+"/metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	// Fields have a single value or a list of values
+	var result struct {
+		Result map[string]json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string][]string, len(result.Result))
+	for key, raw := range result.Result {
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				continue
+			}
+			values = []string{value}
+		}
+		metadata[key] = values
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,296 @@
+package warchangel
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIAS3 is an IA S3 endpoint storing the files it receives, in a single request or in parts
+type fakeIAS3 struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	files   map[string]string
+	headers map[string]http.Header
+	parts   map[string]string
+	aborted int
+	// metadata is the metadata of the items, patched by the metadata API
+	metadata map[string]map[string]any
+	// corrupt makes the ETags wrong, slowDown answers 503 SlowDown to every request
+	corrupt  bool
+	slowDown bool
+}
+
+func newFakeIAS3(t *testing.T) (*fakeIAS3, *iaS3Backend) {
+	s3 := &fakeIAS3{
+		files:    make(map[string]string),
+		headers:  make(map[string]http.Header),
+		parts:    make(map[string]string),
+		metadata: make(map[string]map[string]any),
+	}
+
+	s3.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s3.mu.Lock()
+		defer s3.mu.Unlock()
+
+		if item, ok := strings.CutPrefix(r.URL.Path, "/metadata/"); ok {
+			s3.serveMetadata(w, r, item)
+			return
+		}
+
+		if s3.slowDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+			return
+		}
+		if r.Header.Get("Authorization") != "LOW key:secret" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<Error><Code>AccessDenied</Code></Error>`)
+			return
+		}
+
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			s3.headers[r.URL.Path] = r.Header.Clone()
+			io.WriteString(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && query.Get("uploadId") == "upload-1":
+			body, _ := io.ReadAll(r.Body)
+			s3.parts[query.Get("partNumber")] = string(body)
+			w.Header().Set("ETag", s3.etag(body))
+		case r.Method == http.MethodPost && query.Get("uploadId") == "upload-1":
+			var completion completeMultipartUpload
+			if err := xml.NewDecoder(r.Body).Decode(&completion); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var file strings.Builder
+			for _, part := range completion.Parts {
+				file.WriteString(s3.parts[strconv.Itoa(part.PartNumber)])
+			}
+			s3.files[r.URL.Path] = file.String()
+			io.WriteString(w, `<CompleteMultipartUploadResult><ETag>"x-2"</ETag></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodDelete && query.Get("uploadId") == "upload-1":
+			s3.aborted++
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			s3.files[r.URL.Path] = string(body)
+			s3.headers[r.URL.Path] = r.Header.Clone()
+			w.Header().Set("ETag", s3.etag(body))
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s3.server.Close)
+
+	backend := newIAS3Backend("key", "secret")
+	backend.endpoint = s3.server.URL
+	backend.frontEndpoint = s3.server.URL
+
+	return s3, backend
+}
+
+// serveMetadata answers the metadata API: reading the metadata of an item, and patching it
+// with add operations
+func (s3 *fakeIAS3) serveMetadata(w http.ResponseWriter, r *http.Request, item string) {
+	if item, ok := strings.CutSuffix(item, "/metadata"); ok && r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(map[string]any{"result": s3.metadata[item]})
+		return
+	}
+
+	if r.FormValue("access") != "key" || r.FormValue("secret") != "secret" || r.FormValue("-target") != "metadata" {
+		json.NewEncoder(w).Encode(map[string]any{"success": false, "error": "unauthorized"})
+		return
+	}
+
+	var patch []struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(r.FormValue("-patch")), &patch); err != nil {
+		json.NewEncoder(w).Encode(map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+
+	for _, operation := range patch {
+		s3.metadata[item][strings.TrimPrefix(operation.Path, "/")] = operation.Value
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"success": true})
+}
+
+func (s3 *fakeIAS3) etag(body []byte) string {
+	if s3.corrupt {
+		body = append(body, '!')
+	}
+	sum := md5.Sum(body)
+
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func md5Hex(body string) string {
+	sum := md5.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIAS3BackendPut(t *testing.T) {
+	s3, backend := newFakeIAS3(t)
+
+	upload := testUpload("WEB-20240109170659-endgame", "WEB-20240109170659538-00001-endgame.local.warc.gz", "first")
+	upload.MD5 = md5Hex("first")
+
+	remote, err := backend.Put(context.Background(), upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := upload.Item + "/" + upload.Filename; remote != expected {
+		t.Errorf("expected the remote %s, got %s", expected, remote)
+	}
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	path := "/" + remote
+	if body := s3.files[path]; body != "first" {
+		t.Errorf("expected the file to be uploaded, got %q", body)
+	}
+
+	headers := s3.headers[path]
+	for name, expected := range map[string]string{
+		"x-archive-auto-make-bucket": "1",
+		"x-archive-size-hint":        "5",
+		"x-archive-queue-derive":     "0",
+		"x-archive-meta-collection":  "test",
+		"Content-MD5":                upload.MD5,
+	} {
+		if value := headers.Get(name); value != expected {
+			t.Errorf("expected the header %s to be %q, got %q", name, expected, value)
+		}
+	}
+}
+
+func TestIAS3BackendMultipart(t *testing.T) {
+	s3, backend := newFakeIAS3(t)
+	backend.partSize = 4
+
+	body := "0123456789"
+	upload := testUpload("WEB-20240109170659-endgame", "WEB-20240109170659538-00001-endgame.local.warc.gz", body)
+	upload.MD5 = md5Hex(body)
+	upload.Derive = true
+
+	remote, err := backend.Put(context.Background(), upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	if len(s3.parts) != 3 {
+		t.Errorf("expected 3 parts, got %v", s3.parts)
+	}
+	if uploaded := s3.files["/"+remote]; uploaded != body {
+		t.Errorf("expected the parts to make up the file, got %q", uploaded)
+	}
+
+	// The item is created, with its metadata, when the multipart upload starts
+	headers := s3.headers["/"+remote]
+	if headers.Get("x-archive-auto-make-bucket") != "1" || headers.Get("x-archive-size-hint") != "10" || headers.Get("x-archive-queue-derive") != "1" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestIAS3BackendChecksum(t *testing.T) {
+	s3, backend := newFakeIAS3(t)
+	s3.mu.Lock()
+	s3.corrupt = true
+	s3.mu.Unlock()
+
+	if _, err := backend.Put(context.Background(), testUpload("item", "single.warc.gz", "first")); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("expected a corrupted upload to fail, got %v", err)
+	}
+
+	backend.partSize = 4
+	if _, err := backend.Put(context.Background(), testUpload("item", "multipart.warc.gz", "0123456789")); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("expected a corrupted part to fail, got %v", err)
+	}
+
+	// A file that doesn't match the expected checksum fails even if it was received intact
+	s3.mu.Lock()
+	if s3.aborted != 1 {
+		t.Errorf("expected the failed multipart upload to be aborted, got %d aborts", s3.aborted)
+	}
+	s3.corrupt = false
+	s3.mu.Unlock()
+
+	upload := testUpload("item", "changed.warc.gz", "first")
+	upload.MD5 = md5Hex("other")
+	if _, err := backend.Put(context.Background(), upload); err == nil {
+		t.Error("expected a file not matching its MD5 to fail")
+	}
+}
+
+func TestIAS3BackendErrors(t *testing.T) {
+	s3, backend := newFakeIAS3(t)
+
+	backend.secretKey = "wrong"
+	_, err := backend.Put(context.Background(), testUpload("item", "file.warc.gz", "first"))
+	var iaErr *iaS3Error
+	if !errors.As(err, &iaErr) || iaErr.StatusCode != http.StatusForbidden || iaErr.Code != "AccessDenied" {
+		t.Errorf("expected an AccessDenied error, got %v", err)
+	}
+	if errors.Is(err, ErrSlowDown) {
+		t.Errorf("expected %v not to be a slowdown", err)
+	}
+
+	backend.secretKey = "secret"
+	s3.mu.Lock()
+	s3.slowDown = true
+	s3.mu.Unlock()
+	if _, err := backend.Put(context.Background(), testUpload("item", "file.warc.gz", "first")); !errors.Is(err, ErrSlowDown) {
+		t.Errorf("expected a slowdown, got %v", err)
+	}
+}
+
+func TestIAS3BackendUpdateMetadata(t *testing.T) {
+	s3, backend := newFakeIAS3(t)
+	s3.metadata["item"] = map[string]any{"collection": "test", "subject": []any{"a", "b"}, "title": "Crawl"}
+
+	err := backend.UpdateMetadata(context.Background(), "item", ItemMetadata{
+		"subject":    {"b", "c"},
+		"collection": {"test"},
+		"crawl_note": {"relaunched"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3.mu.Lock()
+	metadata := s3.metadata["item"]
+	if subject, _ := json.Marshal(metadata["subject"]); string(subject) != `["a","b","c"]` {
+		t.Errorf("expected the new values to be added to the existing ones, got %s", subject)
+	}
+	if metadata["crawl_note"] != "relaunched" || metadata["collection"] != "test" || metadata["title"] != "Crawl" {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+	s3.mu.Unlock()
+
+	backend.secretKey = "wrong"
+	if err := backend.UpdateMetadata(context.Background(), "item", ItemMetadata{"subject": {"d"}}); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("expected a refused update to fail, got %v", err)
+	}
+}
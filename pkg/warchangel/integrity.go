@@ -0,0 +1,98 @@
+package warchangel
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// checkIntegrity reads the file once, verifying that its compression stream can be
+// fully decoded if VerifyCompression is enabled, and computing its MD5 checksum if
+// MD5 is enabled. The checksum is empty when it isn't computed. Reading stops with
+// ctx's error when ctx is done.
+func checkIntegrity(ctx context.Context, c *Config, path string) (md5sum string, err error) {
+	if !c.VerifyCompression && !c.MD5 {
+		return "", nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var (
+		reader io.Reader = &contextReader{ctx: ctx, r: file}
+		sum    hash.Hash
+	)
+
+	if c.MD5 {
+		sum = md5.New()
+		reader = io.TeeReader(reader, sum)
+	}
+
+	if c.VerifyCompression {
+		if err := verifyCompression(path, reader); err != nil {
+			return "", fmt.Errorf("integrity check failed: %w", err)
+		}
+	}
+
+	if sum == nil {
+		return "", nil
+	}
+
+	// Hash whatever the decompressor didn't need to read
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// verifyCompression decodes every gzip member or zstd frame read from r
+func verifyCompression(path string, r io.Reader) error {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		_, err = io.Copy(io.Discard, gz)
+		return err
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		_, err = io.Copy(io.Discard, zr)
+		return err
+	default:
+		return nil
+	}
+}
+
+// contextReader stops reading with its context's error once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
@@ -22,7 +22,7 @@ type ParsedFilename struct {
 }
 
 // parseFilename extracts all parts from the filename based on the WARC naming convention.
-func parseFilename(filename string) (*ParsedFilename, error) {
+func parseFilename(naming WARCNaming, filename string) (*ParsedFilename, error) {
 	fullName := filename
 
 	// Remove extensions
@@ -52,7 +52,7 @@ func parseFilename(filename string) (*ParsedFilename, error) {
 		FullName:      fullName,
 	}
 
-	switch config.WARCNaming {
+	switch naming {
 	case ZenoWARCNaming:
 		// Zeno Naming: {TLA}-{timestamp}-{serial}-{fqdn}.warc.gz
 		parsed.FQDN = parts[3]
@@ -80,8 +80,8 @@ func parseFilename(filename string) (*ParsedFilename, error) {
 	return parsed, nil
 }
 
-func getItemName(filename string) (string, error) {
-	parsed, err := parseFilename(filename)
+func getItemName(naming WARCNaming, filename string) (string, error) {
+	parsed, err := parseFilename(naming, filename)
 	if err != nil {
 		return "", err
 	}
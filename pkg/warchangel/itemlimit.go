@@ -0,0 +1,95 @@
+package warchangel
+
+import (
+	"sync"
+)
+
+// itemThreads returns the highest number of parallel uploads into a single item, 0 for no limit
+func (c *Config) itemThreads() int {
+	if c.ItemThreads != nil {
+		return *c.ItemThreads
+	}
+
+	return DefaultItemThreads
+}
+
+// itemUploads spreads the uploads of a job across its items: each item takes up to the job's
+// item_threads uploads at the same time, unless it is 0, and an item that doesn't exist yet takes a single
+// one, so that archive.org creates it once before the other files of the item are sent
+type itemUploads struct {
+	mu      sync.Mutex
+	running map[string]int
+	// created are the items known to exist on archive.org
+	created map[string]bool
+	// changed is closed, and replaced, every time an upload ends
+	changed chan struct{}
+}
+
+func newItemUploads() *itemUploads {
+	return &itemUploads{running: make(map[string]int), created: make(map[string]bool), changed: make(chan struct{})}
+}
+
+// markCreated records that an item exists on archive.org, its files no longer wait for its creation
+func (t *itemUploads) markCreated(item string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.created[item] = true
+}
+
+// isCreated reports whether an item is known to exist on archive.org
+func (t *itemUploads) isCreated(item string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.created[item]
+}
+
+// next removes from the queue the next file whose item can take one more upload, and counts its
+// upload. If the queue only holds files of items that can't, it returns a channel closed once
+// one of the job's uploads ends, nil if the queue is empty.
+func (t *itemUploads) next(c *Config, queue *uploadQueue) (file queuedFile, wait <-chan struct{}, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, ok = queue.popFunc(func(file queuedFile) bool {
+		running, limit := t.running[file.item], c.itemThreads()
+		return (limit == 0 || running < limit) && (running == 0 || t.created[file.item])
+	})
+	if !ok {
+		if queue.Len() == 0 {
+			return queuedFile{}, nil, false
+		}
+		return queuedFile{}, t.changed, false
+	}
+
+	t.running[file.item]++
+
+	return file, nil, true
+}
+
+// end records that an upload counted by next ended
+func (t *itemUploads) end(item string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running[item]--; t.running[item] <= 0 {
+		delete(t.running, item)
+	}
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// uploading returns the number of uploads in progress into each item
+func (t *itemUploads) uploading() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	uploading := make(map[string]int, len(t.running))
+	for item, running := range t.running {
+		uploading[item] = running
+	}
+
+	return uploading
+}
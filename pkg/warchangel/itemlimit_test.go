@@ -0,0 +1,136 @@
+package warchangel
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestItemUploadsNext(t *testing.T) {
+	c := testJobConfig(t, "test")
+	items := newItemUploads()
+	items.markCreated("b")
+
+	q := newUploadQueue(OrderName)
+	for _, name := range []string{"a1", "a2", "a3", "b1", "b2", "b3"} {
+		q.push(queuedFile{name: name, item: name[:1]})
+	}
+
+	next := func(expected string) {
+		t.Helper()
+
+		file, wait, ok := items.next(c, q)
+		switch {
+		case expected == "" && (ok || wait == nil):
+			t.Fatalf("expected to wait for an upload to end, got %q", file.name)
+		case expected != "" && (!ok || file.name != expected):
+			t.Fatalf("expected %q, got %q", expected, file.name)
+		}
+	}
+
+	// a doesn't exist yet, its first file goes alone and the other items take its turn
+	next("a1")
+	next("b1")
+	next("b2")
+	next("")
+
+	_, wait, _ := items.next(c, q)
+	items.markCreated("a")
+	items.end("a")
+	select {
+	case <-wait:
+	default:
+		t.Fatal("expected the end of an upload to wake up the waiting files")
+	}
+
+	next("a2")
+	next("a3")
+	next("")
+	if uploading := items.uploading(); uploading["a"] != 2 || uploading["b"] != 2 {
+		t.Errorf("expected 2 uploads into each item, got %v", uploading)
+	}
+
+	items.end("b")
+	next("b3")
+
+	if _, wait, ok := items.next(c, q); ok || wait != nil {
+		t.Error("expected nothing to wait for once the queue is empty")
+	}
+}
+
+func TestItemUploadsNextWithoutLimit(t *testing.T) {
+	c := testJobConfig(t, "test")
+	noLimit := 0
+	c.ItemThreads = &noLimit
+	items := newItemUploads()
+	items.markCreated("b")
+
+	q := newUploadQueue(OrderName)
+	for _, name := range []string{"a1", "a2", "b1", "b2", "b3"} {
+		q.push(queuedFile{name: name, item: name[:1]})
+	}
+
+	// With item_threads set to 0, only the creation of an item holds its files back
+	for _, expected := range []string{"a1", "b1", "b2", "b3"} {
+		if file, _, ok := items.next(c, q); !ok || file.name != expected {
+			t.Fatalf("expected %q, got %q", expected, file.name)
+		}
+	}
+	if _, wait, ok := items.next(c, q); ok || wait == nil {
+		t.Error("expected the files of the item being created to wait")
+	}
+}
+
+func TestJobItemThreads(t *testing.T) {
+	c := testJobConfig(t, "test")
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 100,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": 100,
+		"WEB-20240109170800000-00003-endgame.local.warc.gz": 100,
+		"WEB-20240109170900000-00004-endgame.local.warc.gz": 100,
+	})
+
+	backend := &pausingBackend{started: make(chan string, 4), release: make(chan struct{})}
+	u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Backend: backend})
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		j.scan()
+		j.startQueued()
+	}()
+
+	expectStarts := func(n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			select {
+			case <-backend.started:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %d uploads to start, got %d", n, i)
+			}
+		}
+
+		select {
+		case name := <-backend.started:
+			t.Fatalf("expected only %d uploads to start, %s started too", n, name)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// The item is created by its first file alone, then takes item_threads uploads out of the job's 4
+	expectStarts(1)
+	backend.release <- struct{}{}
+	expectStarts(2)
+
+	close(backend.release)
+	expectStarts(1)
+	<-scanned
+	j.pool.Wait()
+
+	if uploading := j.items.uploading(); len(uploading) != 0 {
+		t.Errorf("expected no upload in progress, got %v", uploading)
+	}
+}
@@ -0,0 +1,564 @@
+package warchangel
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// job watches the WARCs directory of a crawl job and uploads the WARC files it finds
+type job struct {
+	u      *Uploader
+	logger *slog.Logger
+
+	mu     sync.RWMutex
+	config *Config
+	state  *StateStore
+	// pending are the files waiting for an upload slot, pool limits the uploads of the job,
+	// on top of the budget shared by every job
+	pending *uploadQueue
+	pool    *uploadPool
+	// bandwidth caps the rate of the job's uploads together
+	bandwidth *bandwidthLimiter
+	// concurrency adjusts pool's size in adaptive mode
+	concurrency concurrency
+	// items limits the uploads of each item
+	items *itemUploads
+	// reloaded is notified when reload replaced the configuration
+	reloaded chan struct{}
+	// stopped is guarded by mu, done is closed when the job stops
+	stopped bool
+	done    chan struct{}
+	// wake is notified when files are added to pending, dispatcher tracks the goroutine
+	// starting their uploads
+	wake       chan struct{}
+	dispatcher sync.WaitGroup
+	// retries tracks the files waiting for their retry delay
+	retries sync.WaitGroup
+	// notifier reports the files closed in the scanned directories, nil if unavailable
+	notifier *dirNotifier
+	// diskPressure is guarded by mu, diskErr, pauseFile and lastVerify are only used by watch
+	diskPressure bool
+	diskErr      string
+	pauseFile    string
+	lastVerify   time.Time
+	// verifying is set while the uploaded files are verified under disk pressure
+	verifying atomic.Bool
+	verifier  sync.WaitGroup
+	// lastScan is guarded by mu
+	lastScan   time.Time
+	throughput *uploadThroughput
+}
+
+// queuedFile is a WARC file ready to be uploaded into its item
+type queuedFile struct {
+	name     string
+	item     string
+	size     int64
+	modTime  time.Time
+	stream   string
+	serial   int
+	metadata ItemMetadata
+	progress *fileProgress
+	// retries is the number of times the file was queued again after a failed upload
+	retries int
+}
+
+func (u *Uploader) newJob(c *Config, store *StateStore) *job {
+	// Checked by Validate
+	timetable, _ := parseBandwidthLimit(c.BandwidthLimit)
+
+	return &job{
+		u:          u,
+		logger:     u.logger.With("job", c.Job),
+		config:     c,
+		state:      store,
+		pending:    newUploadQueue(c.Order),
+		pool:       newUploadPool(c.Threads),
+		bandwidth:  newBandwidthLimiter(timetable),
+		items:      newItemUploads(),
+		reloaded:   make(chan struct{}, 1),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		throughput: newUploadThroughput(),
+	}
+}
+
+// currentConfig returns the configuration in use, reload can replace it at any time
+// so callers should get it once and use that snapshot for the whole operation
+func (j *job) currentConfig() *Config {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.config
+}
+
+// dirEvent is a file closed after writing in, or moved into, a scanned directory. Overflow
+// means that events were lost and that the directories must be scanned again.
+type dirEvent struct {
+	Path     string
+	Overflow bool
+}
+
+// watch uploads the WARC files as soon as they are closed or moved into the scanned directories,
+// and scans them at the configured interval to catch the files whose events were missed and
+// the new directories, until the job is stopped. It then waits for the job's uploads to finish.
+func (j *job) watch() {
+	c := j.currentConfig()
+
+	j.logger.Info("starting job", "path", c.WARCsDir, "interval", c.ScanInterval, "threads", c.Threads, "state", j.state.Path())
+	ticker := time.NewTicker(time.Duration(c.ScanInterval) * time.Second)
+	defer ticker.Stop()
+
+	var events <-chan dirEvent
+	notifier, err := newDirNotifier()
+	if err != nil {
+		j.logger.Warn("unable to watch the WARCs directory, relying on scans only", "path", c.WARCsDir, "err", err)
+	} else {
+		defer notifier.Close()
+		j.notifier = notifier
+		events = notifier.Events()
+
+		// The directories found under these are watched once scanned
+		for _, root := range c.roots() {
+			j.watchDirs(scanDirs(c, root))
+		}
+	}
+
+	j.startDispatcher()
+	go j.adaptThreads()
+
+	diskTicker := time.NewTicker(diskCheckInterval)
+	defer diskTicker.Stop()
+	j.checkDisk()
+
+	for {
+		select {
+		case <-j.done:
+			j.logger.Info("stopping job, waiting for its uploads to finish")
+			j.dispatcher.Wait()
+			j.retries.Wait()
+			j.pool.Wait()
+			j.verifier.Wait()
+			j.stopDiskPressure()
+			j.logger.Info("all uploads of the job finished")
+			return
+		case <-j.reloaded:
+			c = j.currentConfig()
+			ticker.Reset(time.Duration(c.ScanInterval) * time.Second)
+			j.logger.Info("applied new configuration", "interval", c.ScanInterval, "threads", j.pool.Size())
+		case <-ticker.C:
+			j.scan()
+		case <-diskTicker.C:
+			j.checkDisk()
+		case e, ok := <-events:
+			if !ok {
+				j.logger.Warn("stopped watching the WARCs directory, relying on scans only", "path", c.WARCsDir)
+				j.notifier = nil
+				events = nil
+				continue
+			}
+
+			j.notified(e, events)
+		}
+	}
+}
+
+// notified uploads the files of an event along with the other events already pending, or
+// scans the directories if events were lost
+func (j *job) notified(e dirEvent, events <-chan dirEvent) {
+	c := j.currentConfig()
+	names := make(map[string]bool)
+
+	for {
+		if e.Overflow {
+			j.logger.Warn("missed events of the scanned directories, scanning them")
+			j.scan()
+			return
+		}
+
+		if name, ok := c.fileName(e.Path); ok {
+			names[name] = true
+		}
+
+		select {
+		case next, ok := <-events:
+			if ok {
+				e = next
+				continue
+			}
+		default:
+		}
+
+		break
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	var files []PlannedFile
+	for name := range names {
+		info, err := os.Stat(c.filePath(name))
+		if err != nil {
+			// Already moved away or deleted
+			continue
+		}
+
+		files = append(files, PlannedFile{Name: name, Size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].Name < files[b].Name
+	})
+
+	j.logger.Debug("files closed in the scanned directories", "files", len(files))
+
+	j.upload(c, files)
+}
+
+// watchDirs has the notifier watch the directories, if there is one
+func (j *job) watchDirs(dirs []string) {
+	if j.notifier == nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		if err := j.notifier.Add(dir); err != nil {
+			j.logger.Warn("unable to watch directory, relying on scans only", "path", dir, "err", err)
+		}
+	}
+}
+
+// stop makes the job stop scanning and starting uploads, its uploads in progress still finish
+func (j *job) stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.stopped {
+		j.stopped = true
+		close(j.done)
+	}
+}
+
+// scan looks for new WARC files, assigns them to items and starts their upload
+func (j *job) scan() {
+	c := j.currentConfig()
+
+	j.logger.Debug("watching", "path", c.WARCsDir)
+
+	// Read directories
+	files, dirs, err := discoverWARCs(j.logger, c)
+	if err != nil {
+		j.logger.Error("error reading directory", "err", err)
+		return
+	}
+
+	j.mu.Lock()
+	j.lastScan = time.Now()
+	j.mu.Unlock()
+
+	j.watchDirs(dirs)
+	j.measureBacklog(c, files)
+	j.pruneState(c)
+
+	// Leave the files that may still be written to for a later scan
+	if c.StabilityWait > 0 {
+		stableBefore := time.Now().Add(-time.Duration(c.StabilityWait) * time.Second)
+
+		var stable []PlannedFile
+		for _, file := range files {
+			if file.modTime.Before(stableBefore) {
+				stable = append(stable, file)
+			}
+		}
+		files = stable
+	}
+
+	j.upload(c, files)
+}
+
+// upload assigns the files to items and starts their upload
+func (j *job) upload(c *Config, files []PlannedFile) {
+	queue, err := j.queue(c, files, nil)
+	if err != nil {
+		j.logger.Error("unable to update state", "err", err)
+		return
+	}
+
+	j.start(c, queue)
+}
+
+// submit queues a WARC file of the job, named by its path relative to its root, with
+// extra item metadata, without waiting for it to be stable, and returns its item. The upload
+// starts in the background.
+func (j *job) submit(name string, metadata ItemMetadata) (item string, err error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if j.stopped {
+		return "", ErrStopped
+	}
+
+	c := j.config
+
+	info, err := os.Stat(c.filePath(name))
+	if !c.tracksFile(name) || errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%s: %w", name, ErrUnknownFile)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	queue, err := j.queue(c, []PlannedFile{{Name: name, Size: info.Size()}}, metadata)
+	if err != nil {
+		return "", err
+	}
+
+	if len(queue) == 0 {
+		return "", fmt.Errorf("%s: %w", name, ErrAlreadyHandled)
+	}
+
+	j.logger.Info("file submitted", "file", name, "item", queue[0].item)
+
+	j.start(c, queue)
+
+	return queue[0].item, nil
+}
+
+// queue assigns the files that aren't handled yet to items, recording the
+// metadata submitted with them if any, and marks them in progress
+func (j *job) queue(c *Config, files []PlannedFile, metadata ItemMetadata) (queue []queuedFile, err error) {
+	files = slices.Clone(files)
+	sortForPacking(c.WARCNaming, files)
+
+	var discovered int
+	err = j.state.Update(func(st *State) bool {
+		discovered = 0
+		packer := newItemPacker(c, st, j.logger)
+		created := st.uploadedItems()
+
+		for _, file := range files {
+			// Check if already uploading
+			if _, ok := j.u.inProgress.Load(filepath.Join(c.WARCsDir, file.Name)); ok {
+				continue
+			}
+
+			// Skip files that are already handled, failed files wait for a retry
+			if f, ok := st.Files[file.Name]; ok {
+				switch f.Status {
+				case FileUploaded, FileVerified, FileFailed:
+					continue
+				}
+			}
+
+			if _, ok := st.Files[file.Name]; !ok {
+				discovered++
+			}
+
+			item, err := packer.assign(file.Name, file.Size)
+			if err != nil {
+				j.logger.Error("unable to assign file to an item", "file", file.Name, "err", err)
+				continue
+			}
+
+			f := st.Files[file.Name]
+			if metadata != nil {
+				f.Metadata = metadata
+			}
+
+			stream, serial := fileStream(c.WARCNaming, file.Name)
+			progress := newFileProgress(c.Job, file.Name, item, file.Size, j.throughput)
+			queue = append(queue, queuedFile{
+				name:     file.Name,
+				item:     item,
+				size:     file.Size,
+				modTime:  file.modTime,
+				stream:   stream,
+				serial:   serial,
+				metadata: f.Metadata,
+				progress: progress,
+			})
+
+			// Marked while holding the state lock, so that a concurrent scan or submission skips it
+			j.u.inProgress.Store(filepath.Join(c.WARCsDir, file.Name), progress)
+
+			if created[item] {
+				j.items.markCreated(item)
+			}
+		}
+
+		return len(queue) > 0
+	})
+	if err != nil {
+		for _, file := range queue {
+			j.u.inProgress.Delete(filepath.Join(c.WARCsDir, file.name))
+		}
+
+		return nil, err
+	}
+
+	j.u.metrics.discovered.WithLabelValues(c.Job).Add(float64(discovered))
+
+	return queue, nil
+}
+
+// measureBacklog records the size of the files found by a scan that aren't uploaded yet
+func (j *job) measureBacklog(c *Config, files []PlannedFile) {
+	var backlog int64
+	err := j.state.View(func(st *State) {
+		for _, file := range files {
+			if f, ok := st.Files[file.Name]; ok && (f.Status == FileUploaded || f.Status == FileVerified) {
+				continue
+			}
+			backlog += file.Size
+		}
+	})
+	if err != nil {
+		j.logger.Error("unable to load state", "err", err)
+		return
+	}
+
+	j.u.metrics.backlogBytes.WithLabelValues(c.Job).Set(float64(backlog))
+}
+
+// pruneState forgets the finished files that left the WARCs directory, so that the state
+// only grows with the files on disk
+func (j *job) pruneState(c *Config) {
+	err := j.state.Update(func(st *State) bool {
+		return st.prune(time.Now(), func(name string) bool {
+			_, err := os.Lstat(c.filePath(name))
+			return !errors.Is(err, os.ErrNotExist)
+		})
+	})
+	if err != nil {
+		j.logger.Error("unable to prune state", "err", err)
+	}
+}
+
+// start adds the queued files to the job's upload queue and wakes the dispatcher up to start
+// their uploads, without waiting for upload slots. Once the job is stopped, the files are left
+// queued for the next start.
+func (j *job) start(c *Config, queue []queuedFile) {
+	for _, file := range queue {
+		j.u.emit(Event{Job: c.Job, File: file.name, Item: file.item, Size: file.size, Status: FileQueued})
+	}
+	j.enqueue(c, queue...)
+}
+
+// enqueue adds files to the job's upload queue and wakes the dispatcher up
+func (j *job) enqueue(c *Config, files ...queuedFile) {
+	j.pending.push(files...)
+
+	// The dispatcher may have drained the queue and returned already
+	if j.leaveQueued(c) {
+		return
+	}
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startDispatcher starts the goroutine starting the uploads of the files added to the queue,
+// until the job is stopped
+func (j *job) startDispatcher() {
+	j.dispatcher.Add(1)
+	go func() {
+		defer j.dispatcher.Done()
+
+		for {
+			select {
+			case <-j.wake:
+				j.startQueued()
+			case <-j.done:
+				j.leaveQueued(j.currentConfig())
+				return
+			}
+		}
+	}()
+}
+
+// startQueued starts uploads until the upload queue is empty, each with the next file of the
+// queue whose item can take one more upload, within the job's limit first and then the shared
+// budget, with the configuration in use when the upload starts. It returns early once the job
+// is stopped, leaving the files that didn't start queued.
+func (j *job) startQueued() {
+	for {
+		c := j.currentConfig()
+		if j.leaveQueued(c) {
+			return
+		}
+
+		if !j.pool.Add(j.done) {
+			continue
+		}
+		if !j.u.uploads.Add(j.done) {
+			j.pool.Done()
+			continue
+		}
+
+		// The job may have stopped while waiting for the slots, or for the uploads to resume
+		release, ok := j.u.slowDown.acquire(j.done)
+		if j.leaveQueued(c) {
+			ok = false
+		}
+
+		var (
+			file queuedFile
+			wait <-chan struct{}
+		)
+		if ok {
+			file, wait, ok = j.items.next(c, j.pending)
+		}
+		if !ok {
+			if release != nil {
+				release(false)
+			}
+			j.u.uploads.Done()
+			j.pool.Done()
+			if wait == nil {
+				return
+			}
+
+			// The files waiting are all for items that can't take one more upload, until an
+			// upload ends or other files are queued
+			select {
+			case <-wait:
+			case <-j.wake:
+			case <-j.done:
+			}
+			continue
+		}
+
+		go j.uploadFile(j.u.uploadCtx, c, file, release)
+	}
+}
+
+// leaveQueued empties the upload queue if the job is stopped, and reports whether it is
+func (j *job) leaveQueued(c *Config) bool {
+	select {
+	case <-j.done:
+	default:
+		return false
+	}
+
+	files := j.pending.drain()
+	if len(files) > 0 {
+		j.logger.Info("job stopped, leaving files queued", "files", len(files))
+		for _, file := range files {
+			j.u.inProgress.Delete(filepath.Join(c.WARCsDir, file.name))
+		}
+		j.u.dequeue(c.Job, len(files))
+	}
+
+	return true
+}
@@ -0,0 +1,240 @@
+package warchangel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// jobsFile is a configuration file listing several jobs
+type jobsFile struct {
+	Jobs []json.RawMessage `json:"jobs"`
+}
+
+// LoadJobs loads the configurations of the jobs a daemon runs. path can be:
+//   - a directory, every .json, .yml and .yaml file in it is loaded as a job configuration
+//   - a file listing several job configurations under a jobs key, in JSON or YAML
+//   - a single job configuration, warchangel or Draintasker
+//
+// The jobs are validated together, see ValidateJobs.
+func LoadJobs(path string) ([]*Config, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		configs, err := loadJobsFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return validJobs(configs)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []*Config
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".yml", ".yaml":
+		default:
+			continue
+		}
+
+		fileConfigs, err := loadJobsFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		configs = append(configs, fileConfigs...)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no job configuration found in %s", path)
+	}
+
+	return validJobs(configs)
+}
+
+// validJobs returns the configurations if they can run side by side
+func validJobs(configs []*Config) ([]*Config, error) {
+	if err := ValidateJobs(configs); err != nil {
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+// loadJobsFile loads the job configurations of a single file
+func loadJobsFile(path string) ([]*Config, error) {
+	format, err := DetectConfigFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == FormatDraintasker {
+		c, err := LoadDraintaskerConfig(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*Config{c}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = normalizeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	if _, ok := raw["jobs"]; !ok {
+		c, err := loadConfigData(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*Config{c}, nil
+	}
+
+	var file jobsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	if len(raw) > 1 {
+		var problems []FieldError
+		for key := range raw {
+			if key != "jobs" {
+				problems = append(problems, FieldError{Field: key, Message: "unknown field, a jobs file only lists jobs"})
+			}
+		}
+
+		sort.Slice(problems, func(i, j int) bool {
+			return problems[i].Field < problems[j].Field
+		})
+
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	var (
+		configs  []*Config
+		problems []FieldError
+	)
+	for i, job := range file.Jobs {
+		c, err := loadConfigData(job)
+
+		var validationErr *ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			for _, problem := range validationErr.Problems {
+				problem.Field = fmt.Sprintf("jobs[%d].%s", i, problem.Field)
+				problems = append(problems, problem)
+			}
+		case err != nil:
+			return nil, fmt.Errorf("jobs[%d]: %w", i, err)
+		default:
+			configs = append(configs, c)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	if len(configs) == 0 {
+		return nil, &ValidationError{Problems: []FieldError{{Field: "jobs", Message: "at least one job is required"}}}
+	}
+
+	return configs, nil
+}
+
+// ValidateJobs checks that the jobs can run side by side in the same daemon: each job must be
+// valid on its own, jobs can't share a name, a scanned root or a state file, and a job's roots
+// can't be under the roots of a job scanning their subdirectories
+func ValidateJobs(configs []*Config) error {
+	var (
+		problems []FieldError
+		names    = make(map[string]bool)
+		dirs     = make(map[string]string)
+		states   = make(map[string]string)
+	)
+
+	for _, c := range configs {
+		var validationErr *ValidationError
+		if err := c.Validate(); errors.As(err, &validationErr) {
+			for _, problem := range validationErr.Problems {
+				problem.Field = c.Job + "." + problem.Field
+				problems = append(problems, problem)
+			}
+			continue
+		}
+
+		if names[c.Job] {
+			problems = append(problems, FieldError{Field: c.Job + ".job", Message: "another job has the same name"})
+		}
+		names[c.Job] = true
+
+		for i, root := range c.roots() {
+			dir := filepath.Clean(root)
+			if other, ok := dirs[dir]; ok && other != c.Job {
+				problems = append(problems, FieldError{Field: c.Job + "." + rootField(i), Message: fmt.Sprintf("the job %s watches the same directory", other)})
+			}
+			dirs[dir] = c.Job
+		}
+
+		statePath := filepath.Clean(DefaultStatePath(c))
+		if other, ok := states[statePath]; ok {
+			problems = append(problems, FieldError{Field: c.Job + ".state_file", Message: fmt.Sprintf("the job %s uses the same state file", other)})
+		}
+		states[statePath] = c.Job
+	}
+
+	// A job scanning under its WARCs directory would find the files of the jobs nested in it
+	for _, outer := range configs {
+		if !outer.Recursive && len(outer.Include) == 0 {
+			continue
+		}
+
+		for _, inner := range configs {
+			if inner == outer {
+				continue
+			}
+
+			for _, outerRoot := range outer.roots() {
+				for i, innerRoot := range inner.roots() {
+					rel, err := filepath.Rel(filepath.Clean(outerRoot), filepath.Clean(innerRoot))
+					if err == nil && rel != "." && filepath.IsLocal(rel) {
+						problems = append(problems, FieldError{Field: inner.Job + "." + rootField(i), Message: fmt.Sprintf("the job %s scans the directories under %s", outer.Job, outerRoot)})
+					}
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
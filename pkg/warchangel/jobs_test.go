@@ -0,0 +1,130 @@
+package warchangel
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadJobs(t *testing.T) {
+	job := func(name string) string {
+		return `{"job": "` + name + `", "warcs": "/warcs/` + name + `", "warc_naming": 1, "collections": ["test"]}`
+	}
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		path     string
+		jobs     []string
+		problems []string
+	}{
+		{
+			name:  "single configuration",
+			files: map[string]string{"a.json": job("a")},
+			path:  "a.json",
+			jobs:  []string{"a"},
+		},
+		{
+			name: "directory",
+			files: map[string]string{
+				"a.json":      job("a"),
+				"b.yml":       "job: b\nwarcs: /warcs/b\nwarc_naming: 2\ncollections: [test]\n",
+				"c.json":      `{"jobs": [` + job("c") + `, ` + job("d") + `]}`,
+				"README":      "not a configuration",
+				".hidden.yml": "not: a configuration",
+			},
+			path: ".",
+			jobs: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:  "jobs file",
+			files: map[string]string{"jobs.yaml": "jobs:\n  - job: a\n    warcs: /warcs/a\n    warc_naming: 1\n    collections: [test]\n  - job: b\n    warcs: /warcs/b\n    warc_naming: 1\n    collections: [test]\n"},
+			path:  "jobs.yaml",
+			jobs:  []string{"a", "b"},
+		},
+		{
+			name:     "invalid job in a jobs file",
+			files:    map[string]string{"jobs.json": `{"jobs": [` + job("a") + `, {"job": "b", "warcs": "/warcs/b", "warc_naming": 3, "collections": ["test"], "threds": 2}]}`},
+			path:     "jobs.json",
+			problems: []string{"jobs[1].threds: unknown field", "jobs[1].warc_naming: unknown WARC naming convention 3, must be 1 (Zeno) or 2 (Heritrix)"},
+		},
+		{
+			name:     "jobs file with other keys",
+			files:    map[string]string{"jobs.json": `{"jobs": [` + job("a") + `], "threads": 2}`},
+			path:     "jobs.json",
+			problems: []string{"threads: unknown field, a jobs file only lists jobs"},
+		},
+		{
+			name: "conflicting jobs",
+			files: map[string]string{
+				"a.json": job("a"),
+				"b.json": `{"job": "a", "warcs": "/warcs/b", "warc_naming": 1, "collections": ["test"]}`,
+				"c.json": `{"job": "c", "warcs": "/warcs/a/", "warc_naming": 1, "collections": ["test"]}`,
+			},
+			path: ".",
+			problems: []string{
+				"a.job: another job has the same name",
+				"c.warcs: the job a watches the same directory",
+				"c.state_file: the job a uses the same state file",
+			},
+		},
+		{
+			name: "job nested in a recursive job",
+			files: map[string]string{
+				"a.json": `{"job": "a", "warcs": "/warcs", "recursive": true, "warc_naming": 1, "collections": ["test"]}`,
+				"b.json": job("b"),
+			},
+			path:     ".",
+			problems: []string{"b.warcs: the job a scans the directories under /warcs"},
+		},
+		{
+			name: "roots shared or nested",
+			files: map[string]string{
+				"a.json": `{"job": "a", "warcs": "/warcs/a", "roots": ["/heritrix"], "recursive": true, "warc_naming": 1, "collections": ["test"]}`,
+				"b.json": `{"job": "b", "warcs": "/warcs/b", "roots": ["/heritrix/jobs/b", "/warcs/a"], "warc_naming": 1, "collections": ["test"]}`,
+			},
+			path: ".",
+			problems: []string{
+				"b.roots[1]: the job a watches the same directory",
+				"b.roots[0]: the job a scans the directories under /heritrix",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			configs, err := LoadJobs(filepath.Join(dir, tc.path))
+
+			var problems []string
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				for _, problem := range validationErr.Problems {
+					problems = append(problems, problem.String())
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(problems, tc.problems) {
+				t.Fatalf("unexpected problems\ngot:      %q\nexpected: %q", problems, tc.problems)
+			}
+
+			var jobs []string
+			for _, c := range configs {
+				jobs = append(jobs, c.Job)
+			}
+			if !reflect.DeepEqual(jobs, tc.jobs) {
+				t.Errorf("expected jobs %v, got %v", tc.jobs, jobs)
+			}
+		})
+	}
+}
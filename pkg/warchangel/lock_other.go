@@ -0,0 +1,13 @@
+//go:build !unix
+
+package warchangel
+
+import "sync"
+
+var stateLock sync.Mutex
+
+// lockFile only serializes access within the process on platforms without flock(2)
+func lockFile(path string) (unlock func(), err error) {
+	stateLock.Lock()
+	return stateLock.Unlock, nil
+}
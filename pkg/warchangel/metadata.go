@@ -0,0 +1,82 @@
+package warchangel
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ItemMetadata is the metadata of an Internet Archive item, a key can have multiple values
+type ItemMetadata map[string][]string
+
+// buildItemMetadata returns the metadata of the item a WARC file is uploaded to,
+// from the job configuration and the WARC filename
+func buildItemMetadata(c *Config, filename string) (ItemMetadata, error) {
+	// Extract metadata from filename
+	parsedFilename, err := parseFilename(c.WARCNaming, filepath.Base(filename))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse filename: %w", err)
+	}
+
+	metadata := make(ItemMetadata)
+	for key, values := range c.Metadata {
+		metadata[key] = append(metadata[key], values...)
+	}
+
+	metadata["collection"] = append(metadata["collection"], c.Collections...)
+	metadata["crawler"] = append(metadata["crawler"], parsedFilename.Crawler)
+	metadata["date"] = append(metadata["date"], parsedFilename.FullTimestamp[:4])
+	metadata["description"] = append(metadata["description"], c.Description)
+	metadata["operator"] = append(metadata["operator"], c.Operator)
+	metadata["title"] = append(metadata["title"], c.TitlePrefix)
+	metadata["scanner"] = append(metadata["scanner"], parsedFilename.FQDN)
+
+	return metadata, nil
+}
+
+// keys returns the metadata keys in lexical order
+func (m ItemMetadata) keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Pairs returns the metadata as a sorted list of key=value strings
+func (m ItemMetadata) Pairs() (pairs []string) {
+	for _, key := range m.keys() {
+		for _, value := range m[key] {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	return pairs
+}
+
+// Headers returns the metadata as the x-archive-meta headers of IA's S3 API.
+// Keys with multiple values are numbered, e.g. x-archive-meta01-collection.
+func (m ItemMetadata) Headers() map[string]string {
+	headers := make(map[string]string)
+
+	for _, key := range m.keys() {
+		values := m[key]
+		// IA's S3 API uses -- to encode underscores in header names
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "--")
+
+		if len(values) == 1 {
+			headers["x-archive-meta-"+name] = values[0]
+			continue
+		}
+
+		for i, value := range values {
+			headers[fmt.Sprintf("x-archive-meta%02d-%s", i+1, name)] = value
+		}
+	}
+
+	return headers
+}
@@ -0,0 +1,219 @@
+package warchangel
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Error classes of the failed uploads, see classifiedError
+const (
+	errorClassIntegrity = "integrity" // the file failed the integrity checks
+	errorClassMetadata  = "metadata"  // the item metadata couldn't be built from the filename
+	errorClassIO        = "io"        // the file couldn't be read
+	errorClassBackend   = "backend"   // the backend failed to send the file
+	errorClassTimeout   = "timeout"   // the upload didn't end in time or stopped sending bytes
+	errorClassAborted   = "aborted"   // the upload was aborted at shutdown
+	errorClassSlowDown  = "slowdown"  // archive.org asked to slow down, the file was queued again
+	errorClassOther     = "other"
+)
+
+// classifiedError tags an upload error with its class, for the metrics
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// classify tags err with class, nil stays nil
+func classify(class string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &classifiedError{class: class, err: err}
+}
+
+// errorClass returns the class of an upload error
+func errorClass(err error) string {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+
+	return errorClassOther
+}
+
+// metrics are the Prometheus metrics of an Uploader, labelled by job, in a registry of its own
+type metrics struct {
+	registry *prometheus.Registry
+
+	discovered     *prometheus.CounterVec
+	queued         *prometheus.GaugeVec
+	uploading      *prometheus.GaugeVec
+	uploaded       *prometheus.CounterVec
+	failed         *prometheus.CounterVec
+	uploadedBytes  *prometheus.CounterVec
+	uploadDuration *prometheus.HistogramVec
+	backlogBytes   *prometheus.GaugeVec
+	retries        *prometheus.CounterVec
+	errors         *prometheus.CounterVec
+}
+
+func newMetrics(u *Uploader) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		discovered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "warchangel_files_discovered_total",
+			Help: "WARC files found in the WARCs directory or submitted for the first time.",
+		}, []string{"job"}),
+		queued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "warchangel_files_queued",
+			Help: "WARC files waiting for an upload slot.",
+		}, []string{"job"}),
+		uploading: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "warchangel_files_uploading",
+			Help: "WARC files being uploaded.",
+		}, []string{"job"}),
+		uploaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "warchangel_files_uploaded_total",
+			Help: "WARC files uploaded.",
+		}, []string{"job"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "warchangel_files_failed_total",
+			Help: "WARC files whose upload failed.",
+		}, []string{"job"}),
+		uploadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "warchangel_uploaded_bytes_total",
+			Help: "Bytes of the WARC files uploaded.",
+		}, []string{"job"}),
+		uploadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "warchangel_upload_duration_seconds",
+			Help:    "Duration of the uploads, successful or not, including the integrity checks.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 13), // 1s to about 1h8m
+		}, []string{"job", "status"}),
+		backlogBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "warchangel_backlog_bytes",
+			Help: "Bytes of the WARC files on disk not uploaded yet, as of the last scan.",
+		}, []string{"job"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "warchangel_upload_retries_total",
+			Help: "Uploads of WARC files that were already attempted before.",
+		}, []string{"job"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "warchangel_upload_errors_total",
+			Help: "Failed, retried or aborted uploads, and uploads archive.org asked to slow down, by class of error.",
+		}, []string{"job", "class"}),
+	}
+
+	m.registry.MustRegister(
+		m.discovered, m.queued, m.uploading, m.uploaded, m.failed, m.uploadedBytes,
+		m.uploadDuration, m.backlogBytes, m.retries, m.errors,
+		&stateCollector{u: u},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// observe updates the metrics with the new status of a file
+func (m *metrics) observe(e Event) {
+	switch e.Status {
+	case FileQueued:
+		if e.Err != nil {
+			m.uploading.WithLabelValues(e.Job).Dec()
+			if class := errorClass(e.Err); class != errorClassAborted {
+				m.queued.WithLabelValues(e.Job).Inc()
+				m.errors.WithLabelValues(e.Job, class).Inc()
+			} else {
+				m.errors.WithLabelValues(e.Job, errorClassAborted).Inc()
+			}
+			m.uploadDuration.WithLabelValues(e.Job, string(FileQueued)).Observe(e.Duration.Seconds())
+			return
+		}
+		m.queued.WithLabelValues(e.Job).Inc()
+	case FileUploading:
+		m.queued.WithLabelValues(e.Job).Dec()
+		m.uploading.WithLabelValues(e.Job).Inc()
+		if e.Attempt > 1 {
+			m.retries.WithLabelValues(e.Job).Inc()
+		}
+	case FileUploaded:
+		m.uploading.WithLabelValues(e.Job).Dec()
+		m.uploaded.WithLabelValues(e.Job).Inc()
+		m.uploadedBytes.WithLabelValues(e.Job).Add(float64(e.Size))
+		m.uploadDuration.WithLabelValues(e.Job, string(FileUploaded)).Observe(e.Duration.Seconds())
+	case FileFailed:
+		m.uploading.WithLabelValues(e.Job).Dec()
+		m.failed.WithLabelValues(e.Job).Inc()
+		m.errors.WithLabelValues(e.Job, errorClass(e.Err)).Inc()
+		m.uploadDuration.WithLabelValues(e.Job, string(FileFailed)).Observe(e.Duration.Seconds())
+	}
+}
+
+var (
+	stateFilesDesc = prometheus.NewDesc("warchangel_state_files",
+		"WARC files recorded in the job's state, by status.", []string{"job", "status"}, nil)
+	openItemsDesc = prometheus.NewDesc("warchangel_open_items",
+		"Items still being filled or with files not uploaded yet.", []string{"job"}, nil)
+	openItemsBytesDesc = prometheus.NewDesc("warchangel_open_items_bytes",
+		"Bytes of the files assigned to the open items.", []string{"job"}, nil)
+)
+
+// stateCollector reports the contents of the jobs' state files when scraped, the state being
+// the only place where the files verified by the verify command are known
+type stateCollector struct {
+	u *Uploader
+}
+
+func (s *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stateFilesDesc
+	ch <- openItemsDesc
+	ch <- openItemsBytesDesc
+}
+
+func (s *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	s.u.mu.Lock()
+	jobs := make([]*job, 0, len(s.u.jobs))
+	for _, j := range s.u.jobs {
+		jobs = append(jobs, j)
+	}
+	s.u.mu.Unlock()
+
+	for _, j := range jobs {
+		name := j.currentConfig().Job
+
+		var (
+			files     = map[FileStatus]int{FileQueued: 0, FileUploading: 0, FileUploaded: 0, FileVerified: 0, FileFailed: 0}
+			open      []string
+			openBytes int64
+		)
+		err := j.state.View(func(st *State) {
+			for _, f := range st.Files {
+				files[f.Status]++
+			}
+
+			open = st.OpenItems()
+			for _, item := range open {
+				if itemState := st.Items[item]; itemState != nil {
+					openBytes += itemState.Size
+				}
+			}
+		})
+		if err != nil {
+			j.logger.Error("unable to load state for the metrics", "err", err)
+			continue
+		}
+
+		for status, count := range files {
+			ch <- prometheus.MustNewConstMetric(stateFilesDesc, prometheus.GaugeValue, float64(count), name, string(status))
+		}
+
+		ch <- prometheus.MustNewConstMetric(openItemsDesc, prometheus.GaugeValue, float64(len(open)), name)
+		ch <- prometheus.MustNewConstMetric(openItemsBytesDesc, prometheus.GaugeValue, float64(openBytes), name)
+	}
+}
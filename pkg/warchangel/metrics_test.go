@@ -0,0 +1,105 @@
+package warchangel
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.VerifyCompression = true
+
+	valid := gzipData(t, "WARC/1.1\r\n")
+	files := map[string][]byte{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": valid,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": []byte("not gzip"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(c.WARCsDir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ended := make(chan struct{}, len(files))
+	u, err := New(Options{
+		Jobs:    []*Config{c},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend: newRecordingBackend(),
+		OnEvent: func(e Event) {
+			if e.Status == FileUploaded || e.Status == FileFailed {
+				ended <- struct{}{}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	for name := range files {
+		if _, err := u.Submit(filepath.Join(c.WARCsDir, name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range files {
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the uploads to end")
+		}
+	}
+
+	server := httptest.NewServer(u.StatusHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`warchangel_files_discovered_total{job="test"} 2`,
+		`warchangel_files_queued{job="test"} 0`,
+		`warchangel_files_uploading{job="test"} 0`,
+		`warchangel_files_uploaded_total{job="test"} 1`,
+		`warchangel_files_failed_total{job="test"} 1`,
+		`warchangel_uploaded_bytes_total{job="test"} ` + strconv.Itoa(len(valid)),
+		`warchangel_upload_duration_seconds_count{job="test",status="uploaded"} 1`,
+		`warchangel_upload_errors_total{class="integrity",job="test"} 1`,
+		`warchangel_state_files{job="test",status="failed"} 1`,
+		`warchangel_state_files{job="test",status="uploaded"} 1`,
+		`warchangel_open_items{job="test"} 1`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected the metrics to contain %s", expected)
+		}
+	}
+}
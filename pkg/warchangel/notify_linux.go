@@ -0,0 +1,159 @@
+//go:build linux
+
+package warchangel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// dirNotifier reports the files closed after writing in, or moved into, the directories it
+// watches, using inotify(7)
+type dirNotifier struct {
+	fd     int
+	file   *os.File
+	events chan dirEvent
+	done   chan struct{}
+	once   sync.Once
+
+	mu   sync.Mutex
+	dirs map[int]string
+	wds  map[string]int
+}
+
+func newDirNotifier() (*dirNotifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+
+	// The file is non-blocking so that reads go through the runtime poller and Close interrupts them
+	n := &dirNotifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan dirEvent, 128),
+		done:   make(chan struct{}),
+		dirs:   make(map[int]string),
+		wds:    make(map[string]int),
+	}
+
+	go n.read()
+
+	return n, nil
+}
+
+// Add watches dir too, if it isn't already
+func (n *dirNotifier) Add(dir string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.wds[dir]; ok {
+		return nil
+	}
+
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVE_SELF | unix.IN_ONLYDIR)
+	wd, err := unix.InotifyAddWatch(n.fd, dir, mask)
+	if err != nil {
+		return fmt.Errorf("inotify_add_watch %s: %w", dir, err)
+	}
+
+	n.dirs[wd] = dir
+	n.wds[dir] = wd
+
+	return nil
+}
+
+// Events returns the events of the directories, the channel is closed once the notifier
+// can't report them anymore
+func (n *dirNotifier) Events() <-chan dirEvent {
+	return n.events
+}
+
+func (n *dirNotifier) Close() error {
+	var err error
+	n.once.Do(func() {
+		close(n.done)
+		err = n.file.Close()
+	})
+
+	return err
+}
+
+func (n *dirNotifier) read() {
+	defer close(n.events)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				n.send(dirEvent{Overflow: true})
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= size; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[offset:])))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			name := strings.TrimRight(string(buf[offset+unix.SizeofInotifyEvent:offset+unix.SizeofInotifyEvent+nameLen]), "\x00")
+			offset += unix.SizeofInotifyEvent + nameLen
+
+			e, ok := n.event(wd, mask, name)
+			if ok && !n.send(e) {
+				return
+			}
+		}
+	}
+}
+
+// event returns the event to report for an inotify event, if any
+func (n *dirNotifier) event(wd int, mask uint32, name string) (dirEvent, bool) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		return dirEvent{Overflow: true}, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dir, ok := n.dirs[wd]
+	if !ok {
+		return dirEvent{}, false
+	}
+
+	switch {
+	case mask&unix.IN_IGNORED != 0:
+		// The directory was removed
+		delete(n.dirs, wd)
+		delete(n.wds, dir)
+		return dirEvent{}, false
+	case mask&unix.IN_MOVE_SELF != 0:
+		// The watch follows the directory, the files it reports would have the wrong path:
+		// stop watching it and let a scan find its files wherever they are now
+		unix.InotifyRmWatch(n.fd, uint32(wd))
+		delete(n.dirs, wd)
+		delete(n.wds, dir)
+		return dirEvent{Overflow: true}, true
+	case name != "":
+		return dirEvent{Path: filepath.Join(dir, name)}, true
+	}
+
+	return dirEvent{}, false
+}
+
+// send reports an event, unless the notifier is closed meanwhile
+func (n *dirNotifier) send(e dirEvent) bool {
+	select {
+	case n.events <- e:
+		return true
+	case <-n.done:
+		return false
+	}
+}
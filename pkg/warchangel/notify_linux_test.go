@@ -0,0 +1,119 @@
+//go:build linux
+
+package warchangel
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirNotifier(t *testing.T) {
+	dir := t.TempDir()
+
+	n, err := newDirNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if err := n.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file still being written isn't reported until it's renamed
+	open, err := os.Create(filepath.Join(dir, "WEB-20240109170659538-00001-endgame.local.warc.gz.open"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-n.Events():
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	open.Close()
+	if err := os.Rename(open.Name(), filepath.Join(dir, "WEB-20240109170659538-00001-endgame.local.warc.gz")); err != nil {
+		t.Fatal(err)
+	}
+	writeWARCs(t, dir, map[string]int{"WEB-20240109170700000-00002-endgame.local.warc.gz": 400})
+
+	expected := []string{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz.open",
+		"WEB-20240109170659538-00001-endgame.local.warc.gz",
+		"WEB-20240109170700000-00002-endgame.local.warc.gz",
+	}
+	for _, name := range expected {
+		select {
+		case e := <-n.Events():
+			if e.Path != filepath.Join(dir, name) || e.Overflow {
+				t.Errorf("expected an event for %s, got %+v", name, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected an event for %s", name)
+		}
+	}
+
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-n.Events(); ok {
+		t.Error("expected the events to end once the notifier is closed")
+	}
+}
+
+func TestJobWatchNotified(t *testing.T) {
+	c := testJobConfig(t, "test")
+	// Only the events can start the upload before the test ends
+	c.ScanInterval = 3600
+
+	backend := newRecordingBackend()
+	u, err := New(Options{
+		Jobs:    []*Config{c},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend: backend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	name := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+
+	// The watch starts in the background, write the file until it's picked up
+	deadline := time.After(5 * time.Second)
+	for {
+		writeWARCs(t, c.WARCsDir, map[string]int{name: 600})
+
+		select {
+		case uploaded := <-backend.uploaded:
+			if uploaded != name {
+				t.Fatalf("expected %s to be uploaded, got %s", name, uploaded)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("expected the closed file to be uploaded without waiting for a scan")
+		}
+	}
+}
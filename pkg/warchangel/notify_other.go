@@ -0,0 +1,24 @@
+//go:build !linux
+
+package warchangel
+
+import "errors"
+
+// dirNotifier isn't available on platforms without inotify(7), jobs only rely on their scans
+type dirNotifier struct{}
+
+func newDirNotifier() (*dirNotifier, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (n *dirNotifier) Add(dir string) error {
+	return errors.ErrUnsupported
+}
+
+func (n *dirNotifier) Events() <-chan dirEvent {
+	return nil
+}
+
+func (n *dirNotifier) Close() error {
+	return nil
+}
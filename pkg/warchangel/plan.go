@@ -0,0 +1,176 @@
+package warchangel
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PlannedFile is a WARC file waiting to be uploaded
+type PlannedFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	modTime time.Time
+}
+
+// PlannedItem is a group of WARC files that will be uploaded into the same item
+type PlannedItem struct {
+	Identifier string        `json:"identifier"`
+	Size       int64         `json:"size"`
+	Files      []PlannedFile `json:"files"`
+}
+
+// itemPacker assigns WARC files to items, starting a new item
+// whenever adding a file would exceed the configured item size
+type itemPacker struct {
+	state  *State
+	naming WARCNaming
+	limit  int64
+	logger *slog.Logger
+	// remoteNames are the files of each item by the name they are uploaded under
+	remoteNames map[string]map[string]string
+}
+
+func newItemPacker(c *Config, st *State, l *slog.Logger) *itemPacker {
+	p := &itemPacker{
+		state:       st,
+		naming:      c.WARCNaming,
+		limit:       int64(c.ItemSize) * 1024 * 1024 * 1024,
+		logger:      l,
+		remoteNames: make(map[string]map[string]string),
+	}
+
+	for name, f := range st.Files {
+		if f.Item != "" {
+			p.addRemoteName(f.Item, name)
+		}
+	}
+
+	return p
+}
+
+func (p *itemPacker) addRemoteName(item, name string) {
+	if p.remoteNames[item] == nil {
+		p.remoteNames[item] = make(map[string]string)
+	}
+	p.remoteNames[item][remoteName(name)] = name
+}
+
+// assign returns the item the file belongs to and records the file in the state as queued.
+// A file whose item already holds another file of the same name, from another directory,
+// isn't assigned: archive.org would replace one with the other.
+func (p *itemPacker) assign(name string, size int64) (string, error) {
+	if f, ok := p.state.Files[name]; ok && f.Item != "" {
+		return f.Item, nil
+	}
+
+	item := p.state.CurrentItem
+	current := p.state.Items[item]
+	if current == nil || (current.Size > 0 && current.Size+size > p.limit) {
+		identifier, err := getItemName(p.naming, filepath.Base(name))
+		if err != nil {
+			return "", err
+		}
+		item, current = identifier, nil
+	}
+
+	if other, ok := p.remoteNames[item][remoteName(name)]; ok {
+		return "", fmt.Errorf("item %s already holds %s as %s", item, other, remoteName(name))
+	}
+
+	if current == nil {
+		if p.state.CurrentItem != "" && p.state.Items[p.state.CurrentItem] != nil {
+			p.logger.Info("item size limit reached, starting new item", "item", item, "previous", p.state.CurrentItem)
+		}
+
+		current = p.state.Items[item]
+		if current == nil {
+			current = &ItemState{CreatedAt: time.Now()}
+			p.state.Items[item] = current
+		}
+		p.state.CurrentItem = item
+	}
+
+	current.Size += size
+	current.Files++
+
+	f := p.state.SetFile(name, FileQueued, nil)
+	f.Item = item
+	f.Size = size
+	p.addRemoteName(item, name)
+
+	return f.Item, nil
+}
+
+// isWARC reports whether the filename is a finished WARC file
+func isWARC(name string) bool {
+	return strings.HasSuffix(name, ".warc.zst") || strings.HasSuffix(name, ".warc.gz")
+}
+
+// listWARCs returns the WARC files present in dir, in lexical order
+func listWARCs(l *slog.Logger, dir string) (files []PlannedFile, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isWARC(entry.Name()) {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			l.Error("unable to stat file", "file", entry.Name(), "err", err)
+			continue
+		}
+
+		files = append(files, PlannedFile{Name: entry.Name(), Size: info.Size(), modTime: info.ModTime()})
+	}
+
+	return files, nil
+}
+
+// Plan returns how the WARC files that haven't been handled yet would be grouped
+// into items if they were uploaded now, continuing from the given state.
+// The state is modified as if the files had been queued.
+func Plan(c *Config, l *slog.Logger, st *State) ([]*PlannedItem, error) {
+	files, _, err := discoverWARCs(l, c)
+	if err != nil {
+		return nil, err
+	}
+	sortForPacking(c.WARCNaming, files)
+
+	var (
+		items  []*PlannedItem
+		byName = make(map[string]*PlannedItem)
+		packer = newItemPacker(c, st, l)
+	)
+
+	for _, file := range files {
+		if f, ok := st.Files[file.Name]; ok && f.Status != FileQueued {
+			continue
+		}
+
+		identifier, err := packer.assign(file.Name, file.Size)
+		if err != nil {
+			l.Error("unable to assign file to an item", "file", file.Name, "err", err)
+			continue
+		}
+
+		item, ok := byName[identifier]
+		if !ok {
+			item = &PlannedItem{Identifier: identifier}
+			byName[identifier] = item
+			items = append(items, item)
+		}
+
+		item.Size += file.Size
+		item.Files = append(item.Files, file)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,157 @@
+package warchangel
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeWARCs(t *testing.T, dir string, sizes map[string]int) {
+	t.Helper()
+
+	for name, size := range sizes {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	writeWARCs(t, dir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz":   600,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz":   600,
+		"WEB-20240109170800000-00003-endgame.local.warc.gz":   600,
+		"WEB-20240109170900000-00004-endgame.local.warc.open": 600,
+		"README": 10,
+	})
+
+	c := &Config{WARCsDir: dir, WARCNaming: ZenoWARCNaming, ItemSize: 1}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	st := &State{Items: make(map[string]*ItemState), Files: make(map[string]*FileState)}
+
+	items, err := Plan(c, l, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || len(items[0].Files) != 3 {
+		t.Fatalf("expected the 3 WARCs to fit in a single item with the default size, got %+v", items)
+	}
+
+	st = &State{Items: make(map[string]*ItemState), Files: make(map[string]*FileState)}
+	packer := newItemPacker(c, st, l)
+
+	// 1000 bytes items so that every item holds a single 600 bytes file
+	packer.limit = 1000
+
+	expected := []string{
+		"WEB-20240109170659-endgame",
+		"WEB-20240109170700-endgame",
+		"WEB-20240109170800-endgame",
+	}
+
+	files, err := listWARCs(l, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 WARCs, got %d", len(files))
+	}
+
+	for i, file := range files {
+		item, err := packer.assign(file.Name, file.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != expected[i] {
+			t.Errorf("expected %s to go in %s, got %s", file.Name, expected[i], item)
+		}
+	}
+
+	// Files that are already assigned keep their item
+	item, err := packer.assign(files[0].Name, files[0].Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != expected[0] {
+		t.Errorf("expected %s to stay in %s, got %s", files[0].Name, expected[0], item)
+	}
+	if st.Items[expected[0]].Files != 1 {
+		t.Errorf("expected item %s to hold 1 file, got %d", expected[0], st.Items[expected[0]].Files)
+	}
+}
+
+func TestPlanSameNameInItem(t *testing.T) {
+	c := &Config{WARCNaming: ZenoWARCNaming, ItemSize: 1}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	st := &State{Items: make(map[string]*ItemState), Files: make(map[string]*FileState)}
+	packer := newItemPacker(c, st, l)
+
+	name := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+	a, b := filepath.Join("a", "warcs", name), filepath.Join("b", "warcs", name)
+	if _, err := packer.assign(a, 600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both would be uploaded as the same file of the item
+	if item, err := packer.assign(b, 600); err == nil {
+		t.Fatalf("expected %s to be rejected, got item %s", b, item)
+	}
+	if _, ok := st.Files[b]; ok {
+		t.Errorf("expected %s to stay out of the state", b)
+	}
+	if item := st.Items["WEB-20240109170659-endgame"]; item.Files != 1 || item.Size != 600 {
+		t.Errorf("expected the item to only hold %s, got %+v", a, item)
+	}
+
+	// The clash is still detected by the next scans
+	packer = newItemPacker(c, st, l)
+	if _, err := packer.assign(b, 600); err == nil {
+		t.Errorf("expected %s to be rejected after a new scan", b)
+	}
+}
+
+func TestStateRequeue(t *testing.T) {
+	store := NewStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	err := store.Update(func(st *State) bool {
+		st.SetFile("a.warc.gz", FileFailed, io.ErrUnexpectedEOF).Item = "item"
+		st.SetFile("b.warc.gz", FileUploaded, nil).Item = "item"
+		st.SetFile("c.warc.gz", FileFailed, io.ErrUnexpectedEOF).Item = "item"
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requeued, err := store.Requeue([]string{"a.warc.gz", "b.warc.gz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requeued) != 1 || requeued[0] != "a.warc.gz" {
+		t.Fatalf("expected only a.warc.gz to be requeued, got %v", requeued)
+	}
+
+	requeued, err = store.Requeue(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requeued) != 1 || requeued[0] != "c.warc.gz" {
+		t.Fatalf("expected c.warc.gz to be requeued, got %v", requeued)
+	}
+
+	st, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := st.Summary()
+	if summary.Files[FileQueued] != 2 || summary.Files[FileUploaded] != 1 || len(summary.Failed) != 0 {
+		t.Errorf("unexpected summary after requeue: %+v", summary)
+	}
+	if st.Files["a.warc.gz"].Item != "item" || st.Files["a.warc.gz"].Error != "" {
+		t.Errorf("expected requeued file to keep its item and lose its error, got %+v", st.Files["a.warc.gz"])
+	}
+}
@@ -0,0 +1,96 @@
+package warchangel
+
+import (
+	"sync"
+)
+
+// uploadPool limits the number of concurrent uploads. Unlike a sized wait
+// group, its size can be changed while uploads are running: growing it
+// releases waiting uploads right away, shrinking it lets the running
+// uploads finish and only holds back the next ones. A size of 0 or less
+// doesn't limit the number of uploads.
+type uploadPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int
+	running int
+}
+
+func newUploadPool(size int) *uploadPool {
+	p := &uploadPool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// Add blocks until a slot is available and takes it, or until done is closed, and reports
+// whether it took a slot
+func (p *uploadPool) Add(done <-chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.size > 0 && p.running >= p.size {
+		// Wake the wait up once done is closed
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	for p.size > 0 && p.running >= p.size {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+
+		p.cond.Wait()
+	}
+
+	p.running++
+
+	return true
+}
+
+// Done releases a slot taken by Add
+func (p *uploadPool) Done() {
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// Wait blocks until every slot is released
+func (p *uploadPool) Wait() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.running > 0 {
+		p.cond.Wait()
+	}
+}
+
+// SetSize changes the number of concurrent uploads allowed
+func (p *uploadPool) SetSize(size int) {
+	p.mu.Lock()
+	p.size = size
+	p.mu.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// Size returns the number of concurrent uploads allowed
+func (p *uploadPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.size
+}
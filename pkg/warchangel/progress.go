@@ -0,0 +1,399 @@
+package warchangel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressCheckInterval is how often the uploads being sent check their progress
+const progressCheckInterval = time.Second
+
+// itemThroughputRetention is how long the throughput of an item without uploads is kept
+const itemThroughputRetention = 24 * time.Hour
+
+// progressInterval returns the delay between the progress logs of each upload
+func (c *Config) progressInterval() time.Duration {
+	if c.ProgressInterval > 0 {
+		return time.Duration(c.ProgressInterval) * time.Second
+	}
+
+	return 60 * time.Second
+}
+
+// stallDelay returns how long an upload can go without sending any byte before it's reported stalled
+func (c *Config) stallDelay() time.Duration {
+	if c.StallAfter > 0 {
+		return time.Duration(c.StallAfter) * time.Second
+	}
+
+	return 60 * time.Second
+}
+
+// fileProgress tracks a WARC file from the moment it's queued until its upload ends
+type fileProgress struct {
+	job        string
+	file       string
+	item       string
+	size       int64
+	queuedAt   time.Time
+	throughput *uploadThroughput
+
+	mu      sync.Mutex
+	started time.Time
+	// sending is when the backend was handed the file, after the integrity checks
+	sending time.Time
+
+	// sent, firstRead and lastRead, in Unix nanoseconds, are updated by the backend's reads, see progressReader
+	sent      atomic.Int64
+	firstRead atomic.Int64
+	lastRead  atomic.Int64
+	stalled   atomic.Bool
+
+	// lastLog, lastLogSent and waiting are only used by watchProgress, waiting is set once the
+	// whole file was sent
+	lastLog     time.Time
+	lastLogSent int64
+	waiting     bool
+}
+
+func newFileProgress(job, file, item string, size int64, throughput *uploadThroughput) *fileProgress {
+	return &fileProgress{job: job, file: file, item: item, size: size, queuedAt: time.Now(), throughput: throughput}
+}
+
+// start records that the upload of the file started
+func (p *fileProgress) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.started = time.Now()
+}
+
+// send records that the file is handed to the backend
+func (p *fileProgress) send() {
+	now := time.Now()
+
+	p.mu.Lock()
+	p.sending = now
+	p.mu.Unlock()
+
+	p.lastRead.Store(now.UnixNano())
+	p.lastLog, p.lastLogSent, p.waiting = now, 0, false
+	p.throughput.begin(p.item, now)
+}
+
+// finish records that the backend is done with the file, successfully or not
+func (p *fileProgress) finish(uploaded bool) {
+	p.throughput.end(p.item, time.Now(), uploaded)
+}
+
+// requeue records that the file is waiting for an upload slot again, its next upload starts over
+func (p *fileProgress) requeue() {
+	p.mu.Lock()
+	p.started, p.sending = time.Time{}, time.Time{}
+	p.mu.Unlock()
+
+	p.sent.Store(0)
+	p.firstRead.Store(0)
+	p.lastRead.Store(0)
+	p.stalled.Store(false)
+}
+
+// latency returns how long the backend took to start reading the file, false if it didn't
+func (p *fileProgress) latency() (time.Duration, bool) {
+	firstRead := p.firstRead.Load()
+	if firstRead == 0 {
+		return 0, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return time.Unix(0, firstRead).Sub(p.sending), true
+}
+
+// rate returns the average number of bytes sent per second since the file was handed to the backend
+func (p *fileProgress) rate(now time.Time) float64 {
+	p.mu.Lock()
+	sending := p.sending
+	p.mu.Unlock()
+
+	if sending.IsZero() || !now.After(sending) {
+		return 0
+	}
+
+	return float64(p.sent.Load()) / now.Sub(sending).Seconds()
+}
+
+// snapshot returns the progress of the file
+func (p *fileProgress) snapshot() FileProgress {
+	now := time.Now()
+	progress := FileProgress{
+		File:     p.file,
+		Item:     p.item,
+		Size:     p.size,
+		Status:   FileQueued,
+		Sent:     p.sent.Load(),
+		QueuedAt: p.queuedAt,
+		Stalled:  p.stalled.Load(),
+	}
+
+	p.mu.Lock()
+	if !p.started.IsZero() {
+		started := p.started
+		progress.Status, progress.Started = FileUploading, &started
+	}
+	p.mu.Unlock()
+
+	progress.Percent = percent(progress.Sent, p.size)
+	if rate := p.rate(now); rate > 0 {
+		progress.BytesPerSecond = math.Round(rate)
+		progress.ETA = eta(p.size-progress.Sent, rate)
+	}
+
+	return progress
+}
+
+// progressReader counts the bytes read from r into its fileProgress and the throughput of its job
+type progressReader struct {
+	progress *fileProgress
+	r        io.Reader
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		r.progress.sent.Add(int64(n))
+		r.progress.firstRead.CompareAndSwap(0, now)
+		r.progress.lastRead.Store(now)
+		r.progress.throughput.add(r.progress.item, int64(n))
+	}
+
+	return n, err
+}
+
+// watchProgress logs the progress of a file being sent at the job's progress interval, reports
+// it stalled when no byte moved for the job's stall delay, and cancels the upload once the job's
+// inactivity timeout is reached, until the returned function is called
+func (j *job) watchProgress(c *Config, p *fileProgress, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(progressCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := j.checkProgress(c, p, now); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// checkProgress logs the progress of a file being sent if the progress interval elapsed since
+// the last log, and logs when it stalls or resumes. It returns an error once no byte moved for
+// the job's inactivity timeout, until the whole file is sent.
+func (j *job) checkProgress(c *Config, p *fileProgress, now time.Time) error {
+	sent := p.sent.Load()
+	lastRead := time.Unix(0, p.lastRead.Load())
+
+	// archive.org can take minutes to answer once it received the whole file, only the upload
+	// timeout limits that wait
+	if p.size > 0 && sent >= p.size {
+		if !p.waiting {
+			p.waiting = true
+			p.stalled.Store(false)
+			j.logger.Info("file sent, waiting for archive.org", "file", p.file, "item", p.item, "size", p.size)
+		}
+		return nil
+	}
+
+	if c.InactivityTimeout > 0 && now.Sub(lastRead) >= time.Duration(c.InactivityTimeout)*time.Second {
+		return fmt.Errorf("no bytes sent for %ds: %w", c.InactivityTimeout, ErrUploadTimeout)
+	}
+
+	if now.Sub(lastRead) >= c.stallDelay() {
+		if !p.stalled.Swap(true) {
+			j.logger.Warn("upload stalled, no bytes sent", "file", p.file, "item", p.item, "sent", sent, "size", p.size, "since", lastRead)
+		}
+	} else if p.stalled.Swap(false) {
+		j.logger.Info("upload resumed", "file", p.file, "item", p.item, "sent", sent, "size", p.size)
+	}
+
+	elapsed := now.Sub(p.lastLog)
+	if elapsed < c.progressInterval() {
+		return nil
+	}
+
+	rate := float64(sent-p.lastLogSent) / elapsed.Seconds()
+	p.lastLog, p.lastLogSent = now, sent
+
+	args := []any{"file", p.file, "item", p.item, "sent", sent, "size", p.size, "percent", percent(sent, p.size), "mbps", megabytes(rate)}
+	if rate > 0 {
+		args = append(args, "eta", eta(p.size-sent, rate))
+	}
+
+	j.logger.Info("upload progress", args...)
+
+	return nil
+}
+
+// Throughput is the amount of data sent by uploads, and the rate at which it was sent while
+// at least one of them was in progress
+type Throughput struct {
+	// Files are the files uploaded
+	Files          int     `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// throughput accumulates the bytes sent by the uploads of a job or an item, and the time spent
+// with at least one of them in progress
+type throughput struct {
+	files     int
+	bytes     int64
+	active    int
+	busy      time.Duration
+	busySince time.Time
+	lastEnd   time.Time
+}
+
+func (t *throughput) begin(now time.Time) {
+	if t.active == 0 {
+		t.busySince = now
+	}
+	t.active++
+}
+
+func (t *throughput) end(now time.Time, uploaded bool) {
+	t.active--
+	if t.active == 0 {
+		t.busy += now.Sub(t.busySince)
+	}
+	if uploaded {
+		t.files++
+	}
+	t.lastEnd = now
+}
+
+func (t *throughput) snapshot(now time.Time) Throughput {
+	busy := t.busy
+	if t.active > 0 {
+		busy += now.Sub(t.busySince)
+	}
+
+	snapshot := Throughput{Files: t.files, Bytes: t.bytes}
+	if busy > 0 {
+		snapshot.BytesPerSecond = math.Round(float64(t.bytes) / busy.Seconds())
+	}
+
+	return snapshot
+}
+
+// uploadThroughput is the throughput of a job, overall and by item, since it started
+type uploadThroughput struct {
+	mu    sync.Mutex
+	job   throughput
+	items map[string]*throughput
+}
+
+func newUploadThroughput() *uploadThroughput {
+	return &uploadThroughput{items: make(map[string]*throughput)}
+}
+
+// begin records that a file of the item is being sent
+func (t *uploadThroughput) begin(item string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.job.begin(now)
+
+	i, ok := t.items[item]
+	if !ok {
+		i = &throughput{}
+		t.items[item] = i
+	}
+	i.begin(now)
+}
+
+// add records bytes of a file of the item sent
+func (t *uploadThroughput) add(item string, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.job.bytes += n
+	if i, ok := t.items[item]; ok {
+		i.bytes += n
+	}
+}
+
+// end records that a file of the item isn't being sent anymore, and forgets the items
+// without uploads for a while
+func (t *uploadThroughput) end(item string, now time.Time, uploaded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.job.end(now, uploaded)
+	if i, ok := t.items[item]; ok {
+		i.end(now, uploaded)
+	}
+
+	for name, i := range t.items {
+		if i.active == 0 && now.Sub(i.lastEnd) > itemThroughputRetention {
+			delete(t.items, name)
+		}
+	}
+}
+
+// snapshot returns the throughput of the job and of the items it sent files of
+func (t *uploadThroughput) snapshot() (job Throughput, items map[string]Throughput) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	items = make(map[string]Throughput, len(t.items))
+	for name, i := range t.items {
+		items[name] = i.snapshot(now)
+	}
+
+	return t.job.snapshot(now), items
+}
+
+// percent returns the share of size that sent is, rounded to a tenth of a percent
+func percent(sent, size int64) float64 {
+	if size <= 0 {
+		return 0
+	}
+
+	return min(math.Round(float64(sent)/float64(size)*1000)/10, 100)
+}
+
+// megabytes converts a rate in bytes per second to megabytes per second, rounded to the hundredth
+func megabytes(rate float64) float64 {
+	return math.Round(rate/1e4) / 100
+}
+
+// eta returns how long sending the remaining bytes takes at rate bytes per second, to the second
+func eta(remaining int64, rate float64) time.Duration {
+	return time.Duration(float64(max(remaining, 0)) / rate * float64(time.Second)).Round(time.Second)
+}
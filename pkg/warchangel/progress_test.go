@@ -0,0 +1,148 @@
+package warchangel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckProgress(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.ProgressInterval = 30
+	c.StallAfter = 10
+
+	var logs bytes.Buffer
+	u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+
+	p := newFileProgress(c.Job, "WEB-20240109170659538-00001-endgame.local.warc.gz", "WEB-20240109170659-endgame", 4000, j.throughput)
+	p.start()
+	p.send()
+	sending := p.lastLog
+
+	r := &progressReader{progress: p, r: strings.NewReader(strings.Repeat("x", 4000))}
+	if _, err := io.CopyN(io.Discard, r, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		after    time.Duration
+		stalled  bool
+		expected string
+	}{
+		{after: 5 * time.Second},
+		{after: 12 * time.Second, stalled: true, expected: `msg="upload stalled, no bytes sent"`},
+		// 1000 bytes in 30 seconds, 3000 bytes to go, the stall was already reported
+		{after: 30 * time.Second, stalled: true, expected: `msg="upload progress" job=test file=WEB-20240109170659538-00001-endgame.local.warc.gz item=WEB-20240109170659-endgame sent=1000 size=4000 percent=25 mbps=0 eta=1m30s`},
+		{after: 31 * time.Second, stalled: true},
+	}
+
+	for i, step := range steps {
+		logs.Reset()
+		j.checkProgress(c, p, sending.Add(step.after))
+
+		if p.stalled.Load() != step.stalled {
+			t.Errorf("step %d: expected stalled to be %t", i, step.stalled)
+		}
+		if step.expected == "" && logs.Len() > 0 || strings.Count(logs.String(), "\n") > 1 {
+			t.Errorf("step %d: unexpected logs %s", i, logs.String())
+		}
+		if !strings.Contains(logs.String(), step.expected) {
+			t.Errorf("step %d: expected the logs to contain %s, got %s", i, step.expected, logs.String())
+		}
+	}
+
+	// The stall is reported once, and the upload resumes as soon as bytes move again
+	if _, err := io.CopyN(io.Discard, r, 1000); err != nil {
+		t.Fatal(err)
+	}
+	logs.Reset()
+	j.checkProgress(c, p, time.Now())
+	if p.stalled.Load() || !strings.Contains(logs.String(), `msg="upload resumed"`) {
+		t.Errorf("expected the upload to resume, got %s", logs.String())
+	}
+
+	p.finish(false)
+	throughput, items := j.throughput.snapshot()
+	if throughput.Bytes != 2000 || throughput.Files != 0 || items[p.item].Bytes != 2000 {
+		t.Errorf("unexpected throughput %+v %+v", throughput, items)
+	}
+}
+
+func TestUploadThroughput(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	throughput := newUploadThroughput()
+
+	// Two uploads of the same item overlap, the item is busy for 4 seconds
+	throughput.begin("a", start)
+	throughput.add("a", 1000)
+	throughput.begin("a", start.Add(time.Second))
+	throughput.add("a", 1000)
+	throughput.end("a", start.Add(3*time.Second), true)
+	throughput.end("a", start.Add(4*time.Second), false)
+
+	throughput.begin("b", start.Add(10*time.Second))
+	throughput.add("b", 3000)
+	throughput.end("b", start.Add(11*time.Second), true)
+
+	job, items := throughput.snapshot()
+	if expected := (Throughput{Files: 2, Bytes: 5000, BytesPerSecond: 1000}); job != expected {
+		t.Errorf("expected the job throughput %+v, got %+v", expected, job)
+	}
+	if expected := (Throughput{Files: 1, Bytes: 2000, BytesPerSecond: 500}); items["a"] != expected {
+		t.Errorf("expected the item throughput %+v, got %+v", expected, items["a"])
+	}
+	if expected := (Throughput{Files: 1, Bytes: 3000, BytesPerSecond: 3000}); items["b"] != expected {
+		t.Errorf("expected the item throughput %+v, got %+v", expected, items["b"])
+	}
+
+	// The items without uploads for a day are forgotten
+	throughput.begin("c", start.Add(25*time.Hour))
+	throughput.end("c", start.Add(25*time.Hour), true)
+	if _, items := throughput.snapshot(); len(items) != 1 {
+		t.Errorf("expected the old items to be forgotten, got %+v", items)
+	}
+}
+
+func TestCheckProgressWaitingForArchive(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.StallAfter = 10
+	c.InactivityTimeout = 20
+
+	var logs bytes.Buffer
+	u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+
+	p := newFileProgress(c.Job, "WEB-20240109170659538-00001-endgame.local.warc.gz", "WEB-20240109170659-endgame", 4000, j.throughput)
+	p.start()
+	p.send()
+	sending := p.lastLog
+
+	r := &progressReader{progress: p, r: strings.NewReader(strings.Repeat("x", 4000))}
+	if _, err := io.CopyN(io.Discard, r, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.checkProgress(c, p, sending.Add(time.Minute)); !errors.Is(err, ErrUploadTimeout) {
+		t.Fatalf("expected the upload sending nothing to time out, got %v", err)
+	}
+
+	// Once the whole file is sent, waiting for archive.org's answer is neither a stall nor inactivity
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	for _, after := range []time.Duration{time.Minute, 10 * time.Minute} {
+		if err := j.checkProgress(c, p, sending.Add(after)); err != nil {
+			t.Errorf("expected no timeout while waiting for archive.org, got %v", err)
+		}
+		if p.stalled.Load() {
+			t.Error("expected the upload not to be reported stalled while waiting for archive.org")
+		}
+	}
+	if strings.Count(logs.String(), "waiting for archive.org") != 1 {
+		t.Errorf("expected the wait to be logged once, got %s", logs.String())
+	}
+}
@@ -0,0 +1,201 @@
+package warchangel
+
+import (
+	"container/heap"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// UploadOrder is the order in which a job uploads the files waiting for an upload slot
+type UploadOrder string
+
+const (
+	OrderName     UploadOrder = "name"     // lexical order of their path, the default
+	OrderOldest   UploadOrder = "oldest"   // oldest modification time first
+	OrderSerial   UploadOrder = "serial"   // lowest serial first, taking turns between the crawler's streams
+	OrderLargest  UploadOrder = "largest"  // largest first
+	OrderSmallest UploadOrder = "smallest" // smallest first
+)
+
+var uploadOrders = []UploadOrder{OrderName, OrderOldest, OrderSerial, OrderLargest, OrderSmallest}
+
+// fileStream returns the stream of WARC files a file belongs to, the files a crawler process
+// writes one after the other in a directory, and its serial in that stream. Files that don't
+// follow the naming convention are streams of their own.
+func fileStream(naming WARCNaming, name string) (stream string, serial int) {
+	parsed, err := parseFilename(naming, filepath.Base(name))
+	if err != nil {
+		return name, 0
+	}
+
+	serial, _ = strconv.Atoi(parsed.Serial)
+
+	return filepath.Join(filepath.Dir(name), parsed.TLA+"-"+parsed.PID+"~"+parsed.FQDN+"~"+parsed.Port), serial
+}
+
+// sortForPacking sorts the files by stream and serial, so that the serials of a stream stay
+// sequential within an item whatever the upload order
+func sortForPacking(naming WARCNaming, files []PlannedFile) {
+	type key struct {
+		stream string
+		serial int
+	}
+
+	keys := make(map[string]key, len(files))
+	for _, file := range files {
+		stream, serial := fileStream(naming, file.Name)
+		keys[file.Name] = key{stream, serial}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := keys[files[i].Name], keys[files[j].Name]
+		if a.stream != b.stream {
+			return a.stream < b.stream
+		}
+		if a.serial != b.serial {
+			return a.serial < b.serial
+		}
+		return files[i].Name < files[j].Name
+	})
+}
+
+// uploadQueue holds the files of a job waiting for an upload slot, the next one to upload
+// according to the job's order first
+type uploadQueue struct {
+	mu    sync.Mutex
+	files fileHeap
+}
+
+func newUploadQueue(order UploadOrder) *uploadQueue {
+	return &uploadQueue{files: fileHeap{order: order}}
+}
+
+func (q *uploadQueue) push(files ...queuedFile) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, file := range files {
+		heap.Push(&q.files, file)
+	}
+}
+
+// pop returns the next file to upload, if any
+func (q *uploadQueue) pop() (file queuedFile, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.files.Len() == 0 {
+		return queuedFile{}, false
+	}
+
+	return heap.Pop(&q.files).(queuedFile), true
+}
+
+// popFunc returns the next file to upload among the ones for which eligible returns true, if any
+func (q *uploadQueue) popFunc(eligible func(file queuedFile) bool) (file queuedFile, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var skipped []queuedFile
+	for q.files.Len() > 0 {
+		next := heap.Pop(&q.files).(queuedFile)
+		if eligible(next) {
+			file, ok = next, true
+			break
+		}
+		skipped = append(skipped, next)
+	}
+
+	for _, next := range skipped {
+		heap.Push(&q.files, next)
+	}
+
+	return file, ok
+}
+
+// drain removes and returns every file of the queue
+func (q *uploadQueue) drain() []queuedFile {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files := q.files.files
+	q.files.files = nil
+
+	return files
+}
+
+func (q *uploadQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.files.Len()
+}
+
+// order returns the order of the files, OrderName if none was set
+func (q *uploadQueue) order() UploadOrder {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.files.order == "" {
+		return OrderName
+	}
+
+	return q.files.order
+}
+
+// setOrder changes the order of the files waiting, and of the ones to come
+func (q *uploadQueue) setOrder(order UploadOrder) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.files.order = order
+	heap.Init(&q.files)
+}
+
+// fileHeap implements heap.Interface, ordering the files according to order
+type fileHeap struct {
+	order UploadOrder
+	files []queuedFile
+}
+
+func (h *fileHeap) Len() int      { return len(h.files) }
+func (h *fileHeap) Swap(i, j int) { h.files[i], h.files[j] = h.files[j], h.files[i] }
+func (h *fileHeap) Push(x any)    { h.files = append(h.files, x.(queuedFile)) }
+
+func (h *fileHeap) Pop() any {
+	last := h.files[len(h.files)-1]
+	h.files = h.files[:len(h.files)-1]
+	return last
+}
+
+func (h *fileHeap) Less(i, j int) bool {
+	a, b := h.files[i], h.files[j]
+
+	switch h.order {
+	case OrderOldest:
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime)
+		}
+	case OrderSerial:
+		if a.serial != b.serial {
+			return a.serial < b.serial
+		}
+	case OrderLargest:
+		if a.size != b.size {
+			return a.size > b.size
+		}
+	case OrderSmallest:
+		if a.size != b.size {
+			return a.size < b.size
+		}
+	}
+
+	// Ties keep the serials of a stream in order
+	if a.stream == b.stream && a.serial != b.serial {
+		return a.serial < b.serial
+	}
+
+	return a.name < b.name
+}
@@ -0,0 +1,120 @@
+package warchangel
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUploadQueue(t *testing.T) {
+	now := time.Now()
+	files := []PlannedFile{
+		{Name: "WEB-20240109170700000-00002-a.local.warc.gz", Size: 300, modTime: now.Add(-2 * time.Hour)},
+		{Name: "WEB-20240109170659538-00001-a.local.warc.gz", Size: 100, modTime: now.Add(-1 * time.Hour)},
+		{Name: "WEB-20240109170800000-00001-b.local.warc.gz", Size: 300, modTime: now.Add(-3 * time.Hour)},
+		{Name: "WEB-20240109170900000-00003-a.local.warc.gz", Size: 200, modTime: now},
+	}
+
+	tests := []struct {
+		order    UploadOrder
+		expected []string
+	}{
+		{
+			order: OrderName,
+			expected: []string{
+				"WEB-20240109170659538-00001-a.local.warc.gz",
+				"WEB-20240109170700000-00002-a.local.warc.gz",
+				"WEB-20240109170800000-00001-b.local.warc.gz",
+				"WEB-20240109170900000-00003-a.local.warc.gz",
+			},
+		},
+		{
+			order: OrderOldest,
+			expected: []string{
+				"WEB-20240109170800000-00001-b.local.warc.gz",
+				"WEB-20240109170700000-00002-a.local.warc.gz",
+				"WEB-20240109170659538-00001-a.local.warc.gz",
+				"WEB-20240109170900000-00003-a.local.warc.gz",
+			},
+		},
+		{
+			order: OrderSerial,
+			expected: []string{
+				"WEB-20240109170659538-00001-a.local.warc.gz",
+				"WEB-20240109170800000-00001-b.local.warc.gz",
+				"WEB-20240109170700000-00002-a.local.warc.gz",
+				"WEB-20240109170900000-00003-a.local.warc.gz",
+			},
+		},
+		{
+			// The files of the same size keep their stream's serial order
+			order: OrderLargest,
+			expected: []string{
+				"WEB-20240109170700000-00002-a.local.warc.gz",
+				"WEB-20240109170800000-00001-b.local.warc.gz",
+				"WEB-20240109170900000-00003-a.local.warc.gz",
+				"WEB-20240109170659538-00001-a.local.warc.gz",
+			},
+		},
+		{
+			order: OrderSmallest,
+			expected: []string{
+				"WEB-20240109170659538-00001-a.local.warc.gz",
+				"WEB-20240109170900000-00003-a.local.warc.gz",
+				"WEB-20240109170700000-00002-a.local.warc.gz",
+				"WEB-20240109170800000-00001-b.local.warc.gz",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.order), func(t *testing.T) {
+			q := newUploadQueue(tc.order)
+			for _, file := range files {
+				stream, serial := fileStream(ZenoWARCNaming, file.Name)
+				q.push(queuedFile{name: file.Name, size: file.Size, modTime: file.modTime, stream: stream, serial: serial})
+			}
+
+			var names []string
+			for {
+				file, ok := q.pop()
+				if !ok {
+					break
+				}
+				names = append(names, file.name)
+			}
+
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("unexpected order\ngot:      %q\nexpected: %q", names, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSortForPacking(t *testing.T) {
+	files := []PlannedFile{
+		{Name: "WEB-20240109170900000-00010-a.local.warc.gz"},
+		{Name: "WEB-20240109170800000-00001-b.local.warc.gz"},
+		{Name: "WEB-20240109170700000-00009-a.local.warc.gz"},
+		{Name: "not-a-zeno.warc.gz"},
+		{Name: "launch-2/WEB-20240109170600000-00001-a.local.warc.gz"},
+	}
+
+	sortForPacking(ZenoWARCNaming, files)
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+
+	expected := []string{
+		"WEB-20240109170700000-00009-a.local.warc.gz",
+		"WEB-20240109170900000-00010-a.local.warc.gz",
+		"WEB-20240109170800000-00001-b.local.warc.gz",
+		"launch-2/WEB-20240109170600000-00001-a.local.warc.gz",
+		"not-a-zeno.warc.gz",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected order\ngot:      %q\nexpected: %q", names, expected)
+	}
+}
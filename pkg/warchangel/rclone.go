@@ -2,66 +2,203 @@ package warchangel
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"strings"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/rclone/rclone/backend/internetarchive"
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/fshttp"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
 )
 
-func initRcloneFS(filename, item string) (fs fs.Fs, err error) {
-	// rcloneConfig := internetarchive.Options{
-	// 	"access_key_id":     S3AccessKey,
-	// 	"secret_access_key": S3SecretKey,
-	// 	"item_derive":       boolToString(intToBool(config.Derive)),
-	// 	"endpoint":          "https://s3.us.archive.org",
-	// 	"front_endpoint":    "https://archive.org",
-	// 	"disable_checksum":  "true",
-	// }
-	rcloneConfig := configmap.New()
-
-	rcloneConfig.Set("access_key_id", S3AccessKey)
-	rcloneConfig.Set("secret_access_key", S3SecretKey)
-	rcloneConfig.Set("item_derive", boolToString(intToBool(config.Derive)))
-	rcloneConfig.Set("endpoint", "https://s3.us.archive.org")
-	rcloneConfig.Set("front_endpoint", "https://archive.org")
-	rcloneConfig.Set("disable_checksum", "true")
-	rcloneConfig.Set("wait_archive", "0")
-
-	// Build IA's item metadata
-	var itemMetadata []string
-	for key, values := range config.Metadata {
-		for _, value := range values {
-			itemMetadata = append(itemMetadata, fmt.Sprintf("%s=%s", key, value))
-		}
+const (
+	defaultS3Endpoint    = "https://s3.us.archive.org"
+	defaultFrontEndpoint = "https://archive.org"
+)
+
+// rcloneIdleTimeout is how long an rclone backend is kept without any upload
+const rcloneIdleTimeout = time.Hour
+
+// rcloneBackend uploads files with rclone's Internet Archive backend. Initializing one means
+// building its configuration and its HTTP clients, so it keeps one for each configuration: the
+// files of every item reuse its connections.
+type rcloneBackend struct {
+	accessKey string
+	secretKey string
+	// endpoint and frontEndpoint are IA S3 and archive.org, defaultS3Endpoint and defaultFrontEndpoint if empty
+	endpoint      string
+	frontEndpoint string
+
+	mu sync.Mutex
+	// backends are the initialized rclone backends by configuration, see rcloneConfig
+	backends map[string]*cachedFs
+	// client asks archive.org's metadata API whether the items exist, existing are the items that do
+	client   *http.Client
+	existing map[string]bool
+}
+
+// cachedFs is an initialized rclone backend, and when it was last used
+type cachedFs struct {
+	f        fs.Fs
+	lastUsed time.Time
+}
+
+// NewRcloneBackend returns a Backend sending the files with rclone's Internet Archive backend instead
+// of IA S3 directly. rclone's backend has no way to set the item metadata nor to queue the derive, so
+// it only suits items that exist already: its Put fails with an error wrapping ErrUnsupportedUpload
+// instead of creating an item without collection nor metadata, or when the upload asks for the derive.
+func NewRcloneBackend(accessKey, secretKey string) Backend {
+	return &rcloneBackend{accessKey: accessKey, secretKey: secretKey}
+}
+
+func (b *rcloneBackend) Put(ctx context.Context, upload *Upload) (remote string, err error) {
+	if upload.Derive {
+		return "", fmt.Errorf("%w: rclone's backend can't queue the derive of item %s", ErrUnsupportedUpload, upload.Item)
+	}
+
+	exists, err := b.itemExists(ctx, upload.Item)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("%w: rclone's backend can't create item %s with its metadata", ErrUnsupportedUpload, upload.Item)
+	}
+
+	f, err := b.fs(ctx, upload)
+	if err != nil {
+		return "", fmt.Errorf("unable to init rclone FS: %w", err)
 	}
 
-	for _, c := range config.Collections {
-		itemMetadata = append(itemMetadata, fmt.Sprintf("collection=%s", c))
+	var hashes map[hash.Type]string
+	if upload.MD5 != "" {
+		hashes = map[hash.Type]string{hash.MD5: upload.MD5}
 	}
 
-	// Extract metadata from filename
-	parsedFilename, err := parseFilename(filename)
+	// The backends aren't bound to an item, the item is the first part of the path
+	src := object.NewStaticObjectInfo(path.Join(upload.Item, upload.Filename), upload.ModTime, upload.Size, true, hashes, f)
+
+	uploaded, err := f.Put(ctx, upload.Body, src)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse filename: %w", err)
+		return "", err
+	}
+
+	return uploaded.Remote(), nil
+}
+
+// itemExists reports whether an item exists on archive.org, asking its metadata API until it does
+func (b *rcloneBackend) itemExists(ctx context.Context, item string) (bool, error) {
+	b.mu.Lock()
+	exists := b.existing[item]
+	if b.client == nil {
+		// Like the rclone backends, with rclone's HTTP settings
+		b.client = fshttp.NewClient(context.WithoutCancel(ctx))
 	}
+	client := b.client
+	b.mu.Unlock()
 
-	itemMetadata = append(itemMetadata, fmt.Sprintf("crawler=%s", parsedFilename.Crawler))
-	itemMetadata = append(itemMetadata, fmt.Sprintf("date=%s", parsedFilename.FullTimestamp[:4]))
-	itemMetadata = append(itemMetadata, fmt.Sprintf("description=%s", config.Description))
-	itemMetadata = append(itemMetadata, fmt.Sprintf("operator=%s", config.Operator))
-	itemMetadata = append(itemMetadata, fmt.Sprintf("title=%s", config.TitlePrefix))
-	itemMetadata = append(itemMetadata, fmt.Sprintf("scanner=%s", parsedFilename.FQDN))
+	if exists {
+		return true, nil
+	}
 
-	rcloneConfig.Set("metadata", strings.Join(itemMetadata, ","))
+	_, frontEndpoint := b.endpoints()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, frontEndpoint+"/metadata/"+url.PathEscape(item), nil)
+	if err != nil {
+		return false, err
+	}
 
-	fs, err = internetarchive.NewFs(context.Background(), filename, item, rcloneConfig)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("unable to fetch metadata of item %s: %w", item, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unable to fetch metadata of item %s: %s", item, resp.Status)
+	}
+
+	// The metadata of an item that doesn't exist is empty
+	var metadata map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return false, fmt.Errorf("unable to decode metadata of item %s: %w", item, err)
+	}
+	if len(metadata) == 0 {
+		return false, nil
+	}
+
+	b.mu.Lock()
+	if b.existing == nil {
+		b.existing = make(map[string]bool)
+	}
+	b.existing[item] = true
+	b.mu.Unlock()
+
+	return true, nil
+}
+
+// fs returns the rclone backend for the configuration of the upload's item, initializing it if needed
+func (b *rcloneBackend) fs(ctx context.Context, upload *Upload) (fs.Fs, error) {
+	config := b.rcloneConfig(upload)
+	key := config.String()
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for k, cached := range b.backends {
+		if now.Sub(cached.lastUsed) > rcloneIdleTimeout {
+			delete(b.backends, k)
+		}
+	}
+
+	if cached, ok := b.backends[key]; ok {
+		cached.lastUsed = now
+		return cached.f, nil
+	}
+
+	// The backend outlives the upload that initializes it
+	f, err := internetarchive.NewFs(context.WithoutCancel(ctx), "internetarchive", "", config)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create Internet Archive S3 client: %w", err)
 	}
 
-	fmt.Printf("root %s", fs.Root())
+	if b.backends == nil {
+		b.backends = make(map[string]*cachedFs)
+	}
+	b.backends[key] = &cachedFs{f: f, lastUsed: now}
 
-	return fs, nil
+	return f, nil
+}
+
+// endpoints returns the IA S3 and archive.org endpoints of the backend
+func (b *rcloneBackend) endpoints() (endpoint, frontEndpoint string) {
+	endpoint, frontEndpoint = b.endpoint, b.frontEndpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	if frontEndpoint == "" {
+		frontEndpoint = defaultFrontEndpoint
+	}
+
+	return endpoint, frontEndpoint
+}
+
+// rcloneConfig returns the configuration of rclone's backend for the item of an upload
+func (b *rcloneBackend) rcloneConfig(upload *Upload) configmap.Simple {
+	endpoint, frontEndpoint := b.endpoints()
+
+	return configmap.Simple{
+		"access_key_id":     b.accessKey,
+		"secret_access_key": b.secretKey,
+		"endpoint":          endpoint,
+		"front_endpoint":    frontEndpoint,
+		"disable_checksum":  boolToString(upload.MD5 == ""),
+		"wait_archive":      "0",
+	}
 }
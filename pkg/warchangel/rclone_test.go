@@ -0,0 +1,219 @@
+package warchangel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// fakeIA is an IA S3 and archive.org endpoint accepting every upload, it counts the
+// connections it accepted
+type fakeIA struct {
+	server      *httptest.Server
+	connections atomic.Int64
+
+	mu   sync.Mutex
+	puts map[string]string
+	auth []string
+	// items are the items that exist
+	items map[string]bool
+}
+
+func newFakeIA(t testing.TB, items ...string) *fakeIA {
+	ia := &fakeIA{puts: make(map[string]string), items: make(map[string]bool)}
+	for _, item := range items {
+		ia.items[item] = true
+	}
+
+	ia.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			ia.mu.Lock()
+			ia.puts[r.URL.Path] = string(body)
+			ia.auth = append(ia.auth, r.Header.Get("Authorization"))
+			ia.items[strings.Split(r.URL.Path, "/")[1]] = true
+			ia.mu.Unlock()
+		case http.MethodGet:
+			// The metadata of the item, empty if it doesn't exist
+			ia.mu.Lock()
+			exists := ia.items[path.Base(r.URL.Path)]
+			ia.mu.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			if !exists {
+				io.WriteString(w, `{}`)
+				return
+			}
+			io.WriteString(w, `{"metadata":{"collection":"test"},"files":[]}`)
+		default:
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		}
+	}))
+	ia.server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			ia.connections.Add(1)
+		}
+	}
+	ia.server.StartTLS()
+	t.Cleanup(ia.server.Close)
+
+	return ia
+}
+
+// backend returns an rclone backend sending to the fake endpoint, and a context trusting its certificate
+func (ia *fakeIA) backend() (context.Context, *rcloneBackend) {
+	ctx, ci := fs.AddConfig(context.Background())
+	ci.InsecureSkipVerify = true
+
+	return ctx, &rcloneBackend{accessKey: "key", secretKey: "secret", endpoint: ia.server.URL, frontEndpoint: ia.server.URL}
+}
+
+func testUpload(item, filename, body string) *Upload {
+	return &Upload{
+		Item:     item,
+		Filename: filename,
+		Size:     int64(len(body)),
+		ModTime:  time.Now(),
+		Metadata: ItemMetadata{"collection": {"test"}},
+		Body:     strings.NewReader(body),
+	}
+}
+
+func TestRcloneBackend(t *testing.T) {
+	ia := newFakeIA(t, "WEB-20240109170659-endgame", "WEB-20240109180000-endgame", "WEB-20240109190000-endgame")
+	ctx, backend := ia.backend()
+
+	uploads := []*Upload{
+		testUpload("WEB-20240109170659-endgame", "WEB-20240109170659538-00001-endgame.local.warc.gz", "first"),
+		testUpload("WEB-20240109170659-endgame", "WEB-20240109170700000-00002-endgame.local.warc.gz", "second"),
+		testUpload("WEB-20240109180000-endgame", "WEB-20240109180000000-00003-endgame.local.warc.gz", "third"),
+	}
+
+	for _, upload := range uploads {
+		remote, err := backend.Put(ctx, upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := upload.Item + "/" + upload.Filename; remote != expected {
+			t.Errorf("expected the remote %s, got %s", expected, remote)
+		}
+	}
+
+	ia.mu.Lock()
+	if body := ia.puts["/WEB-20240109170659-endgame/WEB-20240109170700000-00002-endgame.local.warc.gz"]; body != "second" {
+		t.Errorf("unexpected uploads %v", ia.puts)
+	}
+	for _, auth := range ia.auth {
+		if auth != "LOW key:secret" {
+			t.Errorf("expected the uploads to be authenticated, got %q", auth)
+		}
+	}
+	ia.mu.Unlock()
+
+	// The items share a backend and its connections
+	if len(backend.backends) != 1 {
+		t.Errorf("expected a single backend, got %d", len(backend.backends))
+	}
+	// One connection to IA S3 and to archive.org for rclone's backend, and one for the metadata API
+	if connections := ia.connections.Load(); connections > 3 {
+		t.Errorf("expected the uploads to reuse the connections to IA S3 and archive.org, got %d connections", connections)
+	}
+
+	// rclone's backend can't set the item metadata, items with other metadata share it too
+	other := testUpload("WEB-20240109190000-endgame", "WEB-20240109190000000-00004-endgame.local.warc.gz", "fourth")
+	other.Metadata = ItemMetadata{"collection": {"other"}}
+	if _, err := backend.Put(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.backends) != 1 {
+		t.Errorf("expected a single backend, got %d", len(backend.backends))
+	}
+}
+
+func TestRcloneBackendUnsupported(t *testing.T) {
+	ia := newFakeIA(t, "WEB-20240109170659-endgame")
+	ctx, backend := ia.backend()
+
+	// Creating an item would leave it without collection nor metadata, rclone's backend always skips the derive
+	missing := testUpload("WEB-20240109180000-endgame", "WEB-20240109180000000-00003-endgame.local.warc.gz", "missing")
+	derive := testUpload("WEB-20240109170659-endgame", "WEB-20240109170659538-00001-endgame.local.warc.gz", "derive")
+	derive.Derive = true
+
+	for _, upload := range []*Upload{missing, derive} {
+		if _, err := backend.Put(ctx, upload); !errors.Is(err, ErrUnsupportedUpload) {
+			t.Errorf("expected the upload into %s to be unsupported, got %v", upload.Item, err)
+		}
+	}
+
+	ia.mu.Lock()
+	if len(ia.puts) != 0 {
+		t.Errorf("expected nothing to be uploaded, got %v", ia.puts)
+	}
+	ia.mu.Unlock()
+
+	// Such errors fail the file instead of retrying it
+	err := classify(errorClassMetadata, fmt.Errorf("%w: test", ErrUnsupportedUpload))
+	if isRetryable(err) {
+		t.Errorf("expected %v not to be retried", err)
+	}
+
+	// Once the item exists, its files go through
+	ia.mu.Lock()
+	ia.items[missing.Item] = true
+	ia.mu.Unlock()
+	missing.Body = strings.NewReader("missing")
+	if _, err := backend.Put(ctx, missing); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkRcloneBackend compares initializing rclone's backend for every file, as a new
+// rcloneBackend does, to reusing it for the files of an item
+func BenchmarkRcloneBackend(b *testing.B) {
+	body := strings.Repeat("x", 64<<10)
+
+	for _, bc := range []struct {
+		name   string
+		shared bool
+	}{
+		{name: "per file"},
+		{name: "per item", shared: true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ia := newFakeIA(b, "WEB-20240109170659-endgame")
+			ctx, backend := ia.backend()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !bc.shared {
+					ctx, backend = ia.backend()
+				}
+
+				if _, err := backend.Put(ctx, testUpload("WEB-20240109170659-endgame", "WEB-20240109170659538-00001-endgame.local.warc.gz", body)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(ia.connections.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
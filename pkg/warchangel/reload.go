@@ -0,0 +1,131 @@
+package warchangel
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// unsafeReloadFields are the fields that can't change while a job is running,
+// with the reason why. Jobs are identified by their name, renaming a job
+// stops it and starts a new one.
+var unsafeReloadFields = map[string]string{
+	"warcs":       "the files already queued would be looked for in another directory",
+	"warc_naming": "changing the naming scheme mid-item would mix or split items",
+	"state_file":  "the state of the files in flight would be lost",
+}
+
+// ConfigChange is a configuration field that differs between two configurations
+type ConfigChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// DiffConfig returns the fields that differ between two configurations
+func DiffConfig(old, new *Config) (changes []ConfigChange) {
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+
+	for _, field := range reflect.VisibleFields(oldValue.Type()) {
+		o := oldValue.FieldByIndex(field.Index).Interface()
+		n := newValue.FieldByIndex(field.Index).Interface()
+
+		if !reflect.DeepEqual(o, n) {
+			changes = append(changes, ConfigChange{
+				Field: strings.Split(field.Tag.Get("json"), ",")[0],
+				Old:   o,
+				New:   n,
+			})
+		}
+	}
+
+	return changes
+}
+
+// Reload replaces the jobs of the Uploader with the given configurations, which
+// must be valid together (see ValidateJobs):
+//   - new jobs are started
+//   - running jobs missing from the configurations are stopped, their uploads in progress finish
+//   - the other jobs get their new configuration, unless it changes fields that are unsafe to
+//     change while items are being filled, in which case the job keeps its configuration and
+//     an error is returned for it
+//
+// Changes apply to the next scans and uploads, uploads in progress are not interrupted.
+func (u *Uploader) Reload(configs []*Config) error {
+	if err := ValidateJobs(configs); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.stopped {
+		return ErrStopped
+	}
+
+	var (
+		errs  []error
+		names = make(map[string]bool)
+	)
+	for _, c := range configs {
+		names[c.Job] = true
+
+		j, ok := u.jobs[c.Job]
+		if !ok {
+			u.logger.Info("adding job", "job", c.Job)
+			u.startJob(c)
+			continue
+		}
+
+		if _, err := j.reload(c); err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %w", c.Job, err))
+		}
+	}
+
+	for name, j := range u.jobs {
+		if !names[name] {
+			u.logger.Info("removing job, its uploads in progress will finish", "job", name)
+			j.stop()
+			delete(u.jobs, name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// reload replaces the configuration of the job, unless it changes any of the fields
+// that are unsafe to change while items are being filled
+func (j *job) reload(c *Config) ([]ConfigChange, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	changes := DiffConfig(j.config, c)
+
+	var unsafe []string
+	for _, change := range changes {
+		if reason, ok := unsafeReloadFields[change.Field]; ok {
+			unsafe = append(unsafe, fmt.Sprintf("%s (%s)", change.Field, reason))
+		}
+	}
+
+	if len(unsafe) > 0 {
+		return changes, fmt.Errorf("refusing to reload the configuration, unsafe changes: %s", strings.Join(unsafe, ", "))
+	}
+
+	for _, change := range changes {
+		j.logger.Info("configuration changed", "field", change.Field, "old", change.Old, "new", change.New)
+	}
+
+	j.config = c
+	j.applyLimits()
+
+	// Let the job know, it may already have a pending notification
+	select {
+	case j.reloaded <- struct{}{}:
+	default:
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,191 @@
+package warchangel
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"testing"
+)
+
+// testJobConfig returns a valid job configuration watching a temporary directory
+func testJobConfig(t *testing.T, name string) *Config {
+	c := &Config{
+		Job:         name,
+		WARCsDir:    t.TempDir(),
+		WARCNaming:  ZenoWARCNaming,
+		Collections: []string{"test"},
+	}
+	c.SetDefaults()
+
+	return c
+}
+
+func TestJobReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		fields  []string
+		threads int
+		wantErr bool
+	}{
+		{
+			name:    "no change",
+			change:  func(c *Config) {},
+			threads: DefaultThreads,
+		},
+		{
+			name: "safe changes",
+			change: func(c *Config) {
+				c.Threads = 8
+				c.ScanInterval = 10
+				c.Collections = []string{"test", "other"}
+			},
+			fields:  []string{"scan_interval", "threads", "collections"},
+			threads: 8,
+		},
+		{
+			name:    "unsafe change",
+			change:  func(c *Config) { c.Threads = 8; c.WARCNaming = HeritrixWARCNaming },
+			fields:  []string{"threads", "warc_naming"},
+			threads: DefaultThreads,
+			wantErr: true,
+		},
+	}
+
+	u, err := New(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			running := testJobConfig(t, "test")
+			j := u.newJob(running, nil)
+
+			next := *running
+			tc.change(&next)
+
+			changes, err := j.reload(&next)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var fields []string
+			for _, change := range changes {
+				fields = append(fields, change.Field)
+			}
+			if len(fields) != len(tc.fields) {
+				t.Fatalf("expected changes to %v, got %v", tc.fields, fields)
+			}
+			for i := range fields {
+				if fields[i] != tc.fields[i] {
+					t.Fatalf("expected changes to %v, got %v", tc.fields, fields)
+				}
+			}
+
+			if tc.wantErr && j.currentConfig() != running {
+				t.Error("expected the running configuration to be kept")
+			}
+			if !tc.wantErr && j.currentConfig() != &next {
+				t.Error("expected the new configuration to be used")
+			}
+
+			if j.pool.Size() != tc.threads {
+				t.Errorf("expected %d upload threads, got %d", tc.threads, j.pool.Size())
+			}
+		})
+	}
+}
+
+func TestReloadJobs(t *testing.T) {
+	a, b, c := testJobConfig(t, "a"), testJobConfig(t, "b"), testJobConfig(t, "c")
+
+	u, err := New(Options{
+		Jobs:    []*Config{a, b},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend: &dryRunBackend{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	running := func() (names []string) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		for name := range u.jobs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return names
+	}
+
+	jobConfig := func(name string) *Config {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		return u.jobs[name].currentConfig()
+	}
+
+	// a is reconfigured, b is removed and c is added
+	a2 := *a
+	a2.Threads = 2
+	if err := u.Reload([]*Config{&a2, c}); err != nil {
+		t.Fatal(err)
+	}
+	if names := running(); len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Fatalf("expected jobs a and c to be running, got %v", names)
+	}
+	if jobConfig("a") != &a2 {
+		t.Error("expected job a to use its new configuration")
+	}
+
+	// An unsafe change is rejected for its job only
+	a3, c3 := a2, *c
+	a3.WARCNaming = HeritrixWARCNaming
+	c3.Threads = 3
+	if err := u.Reload([]*Config{&a3, &c3}); err == nil {
+		t.Fatal("expected the unsafe change of job a to be rejected")
+	}
+	if jobConfig("a") != &a2 {
+		t.Error("expected job a to keep its configuration")
+	}
+	if jobConfig("c") != &c3 {
+		t.Error("expected job c to use its new configuration")
+	}
+
+	// Jobs that can't run side by side are rejected altogether
+	b2 := *b
+	b2.WARCsDir = c.WARCsDir
+	if err := u.Reload([]*Config{&a2, &b2, &c3}); err == nil {
+		t.Fatal("expected jobs sharing a WARCs directory to be rejected")
+	}
+	if names := running(); len(names) != 2 {
+		t.Fatalf("expected the running jobs to be kept, got %v", names)
+	}
+
+	// Invalid configurations are rejected altogether
+	c4 := c3
+	c4.Threads = -1
+	if err := u.Reload([]*Config{&a2, &c4}); err == nil {
+		t.Fatal("expected the invalid configuration to be rejected")
+	}
+	if jobConfig("c") != &c3 {
+		t.Error("expected job c to keep its configuration")
+	}
+}
@@ -0,0 +1,86 @@
+package warchangel
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+//go:generate go run gen_schema.go
+
+// ConfigSchema returns the JSON Schema of the warchangel configuration,
+// generated from the Config struct and the rules enforced by Validate
+func ConfigSchema() ([]byte, error) {
+	properties := make(map[string]map[string]interface{})
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Config{})) {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		properties[name] = schemaType(field.Type)
+	}
+
+	// Constraints checked by Validate
+	properties["version"]["minimum"] = 1
+	properties["version"]["maximum"] = ConfigVersion
+	properties["scan_interval"]["minimum"] = 0
+	properties["stability_wait"]["minimum"] = 0
+	properties["item_size"]["minimum"] = 0
+	properties["threads"]["minimum"] = 0
+	properties["item_threads"]["minimum"] = 0
+	properties["min_threads"]["minimum"] = 0
+	properties["max_threads"]["minimum"] = 0
+	properties["warc_naming"]["enum"] = []int{int(ZenoWARCNaming), HeritrixWARCNaming}
+	properties["disk_high_water"]["minimum"] = 0
+	properties["disk_high_water"]["maximum"] = 100
+	properties["disk_low_water"]["minimum"] = 0
+	properties["disk_low_water"]["maximum"] = 100
+	properties["disk_pressure_threads"]["minimum"] = 0
+	properties["progress_interval"]["minimum"] = 0
+	properties["stall_after"]["minimum"] = 0
+	properties["upload_timeout"]["minimum"] = 0
+	properties["inactivity_timeout"]["minimum"] = 0
+	properties["block_delay"]["minimum"] = 0
+	properties["retry_delay"]["minimum"] = 0
+	properties["max_retries"]["minimum"] = 0
+	properties["max_block_count"]["minimum"] = 0
+	properties["upload_order"]["enum"] = uploadOrders
+	properties["derive"]["enum"] = []int{0, 1}
+	properties["collections"]["minItems"] = 1
+	properties["collections"]["items"].(map[string]interface{})["pattern"] = identifierRegexp.String()
+	properties["subject"]["propertyNames"] = map[string]interface{}{"pattern": metadataKeyRegexp.String()}
+
+	schema := map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "warchangel configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"required":             []string{"job", "warcs", "warc_naming", "collections"},
+		"additionalProperties": false,
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// schemaType returns the JSON Schema describing values of type t
+func schemaType(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaType(t.Elem())}
+	case reflect.Pointer:
+		return schemaType(t.Elem())
+	default:
+		return map[string]interface{}{}
+	}
+}
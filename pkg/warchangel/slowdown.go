@@ -0,0 +1,157 @@
+package warchangel
+
+import (
+	"sync"
+	"time"
+)
+
+// slowDownRampEnd is the number of parallel uploads from which the uploads are back to normal
+// after a pause, the jobs' own limits apply from then on
+const slowDownRampEnd = 64
+
+// blockDelay returns how long the uploads pause when archive.org asks to slow down
+func (c *Config) blockDelay() time.Duration {
+	if c.BlockDelay > 0 {
+		return time.Duration(c.BlockDelay) * time.Second
+	}
+
+	return 300 * time.Second
+}
+
+// slowDownBreaker pauses the uploads of every job of an Uploader when archive.org asks to
+// slow down, instead of each upload hammering it on its own. Once the pause is over, uploads
+// start again one at a time, and the number of uploads allowed in parallel doubles every time
+// as many uploads went through, until slowDownRampEnd.
+type slowDownBreaker struct {
+	mu sync.Mutex
+	// until is when the pause ends, zero if archive.org never asked to slow down
+	until time.Time
+	// blocks is the number of pauses since the last upload that went through
+	blocks int
+	// ramp is the number of uploads allowed in parallel after a pause, 0 once back to normal,
+	// running are the uploads started under that limit and done the ones that went through
+	ramp    int
+	running int
+	done    int
+	// changed is closed, and replaced, every time uploads may start
+	changed chan struct{}
+}
+
+func newSlowDownBreaker() *slowDownBreaker {
+	return &slowDownBreaker{changed: make(chan struct{})}
+}
+
+// trip pauses the uploads for delay, unless they already are, because an upload was asked to
+// slow down at now. It returns the number of pauses since the last upload that went through,
+// and whether this one started a pause: the uploads that started before a pause get asked to
+// slow down as well.
+func (b *slowDownBreaker) trip(now time.Time, delay time.Duration) (blocks int, paused bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Before(b.until) {
+		return b.blocks, false
+	}
+
+	b.blocks++
+	b.until = now.Add(delay)
+	b.ramp, b.done = 1, 0
+
+	return b.blocks, true
+}
+
+// paused returns when the current pause ends, zero when uploads aren't paused
+func (b *slowDownBreaker) paused(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Before(b.until) {
+		return b.until
+	}
+
+	return time.Time{}
+}
+
+// acquire blocks until an upload can start, or until done is closed in which case it returns
+// false. The upload must call release once it ends, telling whether it went through.
+func (b *slowDownBreaker) acquire(done <-chan struct{}) (release func(uploaded bool), ok bool) {
+	for {
+		b.mu.Lock()
+		changed, delay := b.changed, time.Until(b.until)
+		if delay <= 0 && (b.ramp == 0 || b.running < b.ramp) {
+			ramping := b.ramp > 0
+			if ramping {
+				b.running++
+			}
+			b.mu.Unlock()
+
+			return func(uploaded bool) { b.release(ramping, uploaded) }, true
+		}
+		b.mu.Unlock()
+
+		// Wait for the end of the pause, or for a slot of the ramp
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+			wait = timer.C
+		}
+
+		select {
+		case <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, false
+		case <-changed:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// release ends an upload started by acquire, ramping tells whether it started under the ramp's limit
+func (b *slowDownBreaker) release(ramping, uploaded bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ramping {
+		b.running--
+	}
+
+	if uploaded {
+		b.blocks = 0
+		if ramping && b.ramp > 0 {
+			b.done++
+			if b.done >= b.ramp {
+				b.ramp, b.done = 2*b.ramp, 0
+			}
+			if b.ramp >= slowDownRampEnd {
+				b.ramp = 0
+			}
+		}
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// pause records that archive.org asked an upload of the job to slow down, pausing the uploads
+// of every job. It returns false when the job gave up on the file, after max_block_count pauses
+// without any upload going through, the file then fails.
+func (j *job) pause(c *Config, file queuedFile, err error) bool {
+	blocks, paused := j.u.slowDown.trip(time.Now(), c.blockDelay())
+	if c.MaxBlockCount > 0 && blocks > c.MaxBlockCount {
+		j.logger.Error("archive.org still asks to slow down, giving up on the file", "file", file.name, "item", file.item, "pauses", blocks-1)
+		return false
+	}
+
+	if paused {
+		j.logger.Warn("archive.org asked to slow down, pausing the uploads", "delay", c.blockDelay(), "pauses", blocks, "err", err)
+	}
+	j.logger.Info("file queued again until the uploads resume", "file", file.name, "item", file.item)
+
+	return true
+}
@@ -0,0 +1,202 @@
+package warchangel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowDownBreaker(t *testing.T) {
+	b := newSlowDownBreaker()
+	never := make(chan struct{})
+
+	release, ok := b.acquire(never)
+	if !ok {
+		t.Fatal("expected uploads to start before any pause")
+	}
+
+	now := time.Now()
+	if blocks, paused := b.trip(now, 100*time.Millisecond); blocks != 1 || !paused {
+		t.Errorf("expected the first slow down to pause the uploads, got %d pauses (%t)", blocks, paused)
+	}
+	// The uploads started before the pause get asked to slow down as well
+	if blocks, paused := b.trip(now.Add(10*time.Millisecond), 100*time.Millisecond); blocks != 1 || paused {
+		t.Errorf("expected the uploads to be paused already, got %d pauses (%t)", blocks, paused)
+	}
+	release(false)
+
+	if until := b.paused(now); !until.Equal(now.Add(100 * time.Millisecond)) {
+		t.Errorf("expected the uploads to be paused until the end of the delay, got %s", until)
+	}
+
+	// Uploads wait for the end of the pause, and a job stopping stops waiting
+	done := make(chan struct{})
+	close(done)
+	if _, ok := b.acquire(done); ok {
+		t.Error("expected a stopped job to stop waiting")
+	}
+
+	started := time.Now()
+	first, ok := b.acquire(never)
+	if !ok || time.Since(started) < 50*time.Millisecond {
+		t.Errorf("expected the upload to wait for the end of the pause, waited %s", time.Since(started))
+	}
+
+	// Uploads start again one at a time
+	acquired := make(chan func(bool), 2)
+	go func() {
+		for range 2 {
+			release, _ := b.acquire(never)
+			acquired <- release
+		}
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected a single upload to start after the pause")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Each success doubles the number of uploads in parallel
+	first(true)
+	second := <-acquired
+	third := <-acquired
+	if b.ramp != 2 || b.running != 2 || b.blocks != 0 {
+		t.Errorf("expected 2 uploads in parallel, got %d (%d running, %d pauses)", b.ramp, b.running, b.blocks)
+	}
+	second(true)
+	third(true)
+
+	for b.ramp > 0 {
+		release, _ := b.acquire(never)
+		release(true)
+	}
+	if b.running != 0 {
+		t.Errorf("expected the uploads to be back to normal, got %d running", b.running)
+	}
+}
+
+// slowDownBackend asks the first slowDowns uploads to slow down
+type slowDownBackend struct {
+	mu        sync.Mutex
+	slowDowns int
+}
+
+func (b *slowDownBackend) Put(ctx context.Context, upload *Upload) (string, error) {
+	if _, err := io.Copy(io.Discard, upload.Body); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.slowDowns > 0 {
+		b.slowDowns--
+		return "", fmt.Errorf("HTTP error 503 (503 Service Unavailable): %w", ErrSlowDown)
+	}
+
+	return upload.Item + "/" + upload.Filename, nil
+}
+
+func TestUploadSlowDown(t *testing.T) {
+	tests := []struct {
+		name          string
+		slowDowns     int
+		maxBlockCount int
+		expected      []FileStatus
+		stats         Stats
+	}{
+		{
+			name:      "queued again",
+			slowDowns: 1,
+			expected:  []FileStatus{FileQueued, FileUploading, FileQueued, FileUploading, FileUploaded},
+			stats:     Stats{Uploaded: 1, UploadedBytes: 600},
+		},
+		{
+			name:          "max block count",
+			slowDowns:     2,
+			maxBlockCount: 1,
+			expected:      []FileStatus{FileQueued, FileUploading, FileQueued, FileUploading, FileFailed},
+			stats:         Stats{Failed: 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testJobConfig(t, "test")
+			c.BlockDelay = 1
+			c.MaxBlockCount = tc.maxBlockCount
+			name := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+			writeWARCs(t, c.WARCsDir, map[string]int{name: 600})
+
+			var (
+				mu     sync.Mutex
+				events []Event
+				ended  = make(chan struct{})
+			)
+			u := newUploader(Options{
+				Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Backend: &slowDownBackend{slowDowns: tc.slowDowns},
+				OnEvent: func(e Event) {
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, e)
+					if e.Status == FileUploaded || e.Status == FileFailed {
+						close(ended)
+					}
+				},
+			})
+			j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+			j.startDispatcher()
+
+			started := time.Now()
+			if _, err := j.submit(name, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-ended:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the upload to end")
+			}
+			j.stop()
+			j.dispatcher.Wait()
+			j.pool.Wait()
+
+			if elapsed := time.Since(started); elapsed < time.Second {
+				t.Errorf("expected the upload to pause for the block delay, took %s", elapsed)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) != len(tc.expected) {
+				t.Fatalf("expected %d events, got %+v", len(tc.expected), events)
+			}
+			for i, e := range events {
+				if e.Status != tc.expected[i] {
+					t.Errorf("event %d: expected %s, got %+v", i, tc.expected[i], e)
+				}
+			}
+			if class := errorClass(events[2].Err); class != errorClassSlowDown {
+				t.Errorf("expected the file to be queued again because of the slow down, got %s", class)
+			}
+
+			if stats := u.Stats(); stats != tc.stats {
+				t.Errorf("expected the stats %+v, got %+v", tc.stats, stats)
+			}
+
+			st, err := j.state.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f := st.Files[filepath.Base(name)]; f == nil || f.Attempts != 2 {
+				t.Errorf("expected 2 attempts, got %+v", f)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package warchangel
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileStatus represents where a WARC file is in the upload pipeline
+type FileStatus string
+
+const (
+	FileQueued    FileStatus = "queued"
+	FileUploading FileStatus = "uploading"
+	FileUploaded  FileStatus = "uploaded"
+	FileVerified  FileStatus = "verified"
+	FileFailed    FileStatus = "failed"
+)
+
+// FileState is the persisted state of a single WARC file
+type FileState struct {
+	Item     string     `json:"item"`
+	Size     int64      `json:"size"`
+	MD5      string     `json:"md5,omitempty"`
+	Status   FileStatus `json:"status"`
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`
+	// Metadata was submitted with the file, it's added to the item's metadata
+	Metadata  ItemMetadata `json:"metadata,omitempty"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// ItemState is the persisted state of an Internet Archive item
+type ItemState struct {
+	Size      int64     `json:"size"`
+	Files     int       `json:"files"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// State is everything warchangel remembers about a job between runs
+type State struct {
+	// CurrentItem is the item new files are currently packed into
+	CurrentItem string                `json:"current_item"`
+	Items       map[string]*ItemState `json:"items"`
+	Files       map[string]*FileState `json:"files"`
+}
+
+// stateRetention is how long the uploaded files that left the WARCs directory stay in the
+// state without being verified
+const stateRetention = 7 * 24 * time.Hour
+
+// StateStore persists a job's State to a JSON file. Every access takes a
+// lock on the file so that the daemon and the CLI commands (status, retry...)
+// can safely work on the same state. The state is kept in memory and only
+// read again from the file when another process changed it.
+type StateStore struct {
+	path string
+
+	mu sync.Mutex
+	// cached is the state as of the file described by cachedInfo, nil until read
+	cached     *State
+	cachedInfo os.FileInfo
+}
+
+// DefaultStatePath returns the state file used when the configuration
+// doesn't specify one.
+func DefaultStatePath(c *Config) string {
+	if c.StateFile != "" {
+		return c.StateFile
+	}
+
+	return filepath.Join(c.WARCsDir, ".warchangel-state.json")
+}
+
+// NewStateStore returns a StateStore backed by the file at path
+func NewStateStore(path string) *StateStore {
+	return &StateStore{path: path}
+}
+
+// Path returns the path of the state file
+func (s *StateStore) Path() string {
+	return s.path
+}
+
+// Load returns a copy of the state, which the caller can keep
+func (s *StateStore) Load() (st *State, err error) {
+	err = s.View(func(current *State) {
+		st = current.clone()
+	})
+
+	return st, err
+}
+
+// View applies fn to the state without copying it. fn must not modify the state nor keep it
+// once it returns. The whole operation holds the state lock.
+func (s *StateStore) View(fn func(st *State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	fn(st)
+
+	return nil
+}
+
+// Update loads the state, applies fn to it and writes it back if fn reports
+// that it modified the state, fn must leave it untouched otherwise. The whole
+// operation holds the state lock.
+func (s *StateStore) Update(fn func(st *State) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if !fn(st) {
+		return nil
+	}
+
+	if err := s.write(st); err != nil {
+		// The state in memory no longer matches the file
+		s.cached = nil
+		return err
+	}
+
+	return nil
+}
+
+// read returns the state in memory, reading the file again if it changed since. s.mu and
+// the file lock must be held.
+func (s *StateStore) read() (*State, error) {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		info = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if s.cached != nil && sameFile(s.cachedInfo, info) {
+		return s.cached, nil
+	}
+
+	st := &State{
+		Items: make(map[string]*ItemState),
+		Files: make(map[string]*FileState),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.cached, s.cachedInfo = st, nil
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+
+	if st.Items == nil {
+		st.Items = make(map[string]*ItemState)
+	}
+
+	if st.Files == nil {
+		st.Files = make(map[string]*FileState)
+	}
+
+	// Stat before reading, a change in between makes the next access read the file again
+	s.cached, s.cachedInfo = st, info
+
+	return st, nil
+}
+
+func (s *StateStore) write(st *State) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a truncated state
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.cached, s.cachedInfo = st, info
+
+	return nil
+}
+
+// sameFile reports whether a and b, nil for a missing file, describe the same unmodified file
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// clone returns a copy of the state that doesn't share its files and items
+func (st *State) clone() *State {
+	c := &State{
+		CurrentItem: st.CurrentItem,
+		Items:       make(map[string]*ItemState, len(st.Items)),
+		Files:       make(map[string]*FileState, len(st.Files)),
+	}
+
+	for name, item := range st.Items {
+		i := *item
+		c.Items[name] = &i
+	}
+	for name, file := range st.Files {
+		f := *file
+		c.Files[name] = &f
+	}
+
+	return c
+}
+
+// prune forgets the files that left the WARCs directory, as no scan can find them again,
+// once verified or stateRetention after their upload so that verify can still check them,
+// and the items left without files other than the current one. exists reports whether a
+// file is still there. It reports whether anything was forgotten.
+func (st *State) prune(now time.Time, exists func(name string) bool) (pruned bool) {
+	for name, f := range st.Files {
+		finished := f.Status == FileVerified || (f.Status == FileUploaded && now.Sub(f.UpdatedAt) > stateRetention)
+		if finished && !exists(name) {
+			delete(st.Files, name)
+			pruned = true
+		}
+	}
+
+	used := make(map[string]bool, len(st.Items))
+	for _, f := range st.Files {
+		used[f.Item] = true
+	}
+	for item := range st.Items {
+		if !used[item] && item != st.CurrentItem {
+			delete(st.Items, item)
+			pruned = true
+		}
+	}
+
+	return pruned
+}
+
+// SetFile records the status of a file, creating its entry if needed
+func (st *State) SetFile(name string, status FileStatus, err error) *FileState {
+	f, ok := st.Files[name]
+	if !ok {
+		f = &FileState{}
+		st.Files[name] = f
+	}
+
+	f.Status = status
+	f.Error = ""
+	if err != nil {
+		f.Error = err.Error()
+	}
+	f.UpdatedAt = time.Now()
+
+	return f
+}
+
+// FilesWithStatus returns the sorted names of the files having one of the given statuses
+func (st *State) FilesWithStatus(statuses ...FileStatus) (names []string) {
+	for name, f := range st.Files {
+		for _, status := range statuses {
+			if f.Status == status {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// uploadedItems returns the items with at least one file uploaded, the ones that exist on archive.org
+func (st *State) uploadedItems() map[string]bool {
+	items := make(map[string]bool)
+	for _, f := range st.Files {
+		if f.Status == FileUploaded || f.Status == FileVerified {
+			items[f.Item] = true
+		}
+	}
+
+	return items
+}
+
+// OpenItems returns the sorted names of the items still being filled, or with files that
+// aren't uploaded yet
+func (st *State) OpenItems() (items []string) {
+	open := make(map[string]bool)
+	for _, f := range st.Files {
+		if f.Status != FileUploaded && f.Status != FileVerified && f.Item != "" {
+			open[f.Item] = true
+		}
+	}
+	if st.CurrentItem != "" {
+		open[st.CurrentItem] = true
+	}
+
+	for item := range open {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+
+	return items
+}
+
+// Requeue puts the given failed files, or every failed file if none is given,
+// back in the upload queue. They keep the item they were assigned to.
+func (s *StateStore) Requeue(files []string) (requeued []string, err error) {
+	err = s.Update(func(st *State) bool {
+		if len(files) == 0 {
+			files = st.FilesWithStatus(FileFailed)
+		}
+
+		for _, name := range files {
+			if f, ok := st.Files[name]; ok && f.Status == FileFailed {
+				st.SetFile(name, FileQueued, nil)
+				requeued = append(requeued, name)
+			}
+		}
+
+		return len(requeued) > 0
+	})
+
+	return requeued, err
+}
+
+// StateSummary is an overview of a job's state
+type StateSummary struct {
+	CurrentItem string               `json:"current_item"`
+	Items       int                  `json:"items"`
+	Files       map[FileStatus]int   `json:"files"`
+	Bytes       map[FileStatus]int64 `json:"bytes"`
+	Failed      map[string]string    `json:"failed,omitempty"`
+}
+
+// Summary counts the files and bytes in each status and lists the failed files with their error
+func (st *State) Summary() *StateSummary {
+	summary := &StateSummary{
+		CurrentItem: st.CurrentItem,
+		Items:       len(st.Items),
+		Files:       make(map[FileStatus]int),
+		Bytes:       make(map[FileStatus]int64),
+		Failed:      make(map[string]string),
+	}
+
+	for name, f := range st.Files {
+		summary.Files[f.Status]++
+		summary.Bytes[f.Status] += f.Size
+		if f.Status == FileFailed {
+			summary.Failed[name] = f.Error
+		}
+	}
+
+	return summary
+}
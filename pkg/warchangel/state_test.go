@@ -0,0 +1,93 @@
+package warchangel
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStoreCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store := NewStateStore(path)
+
+	if err := store.Update(func(st *State) bool {
+		st.SetFile("a.warc.gz", FileQueued, nil)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies don't share the state kept in memory
+	st, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Files["a.warc.gz"].Status = FileFailed
+
+	if err := store.View(func(st *State) {
+		if st.Files["a.warc.gz"].Status != FileQueued {
+			t.Errorf("expected the loaded copy not to change the state, got %s", st.Files["a.warc.gz"].Status)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process, e.g. retry, writing the state makes it read again
+	other := NewStateStore(path)
+	if err := other.Update(func(st *State) bool {
+		st.SetFile("b.warc.gz", FileQueued, nil)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Files) != 2 {
+		t.Errorf("expected the changes of the other store to be read, got %v", st.Files)
+	}
+}
+
+func TestStatePrune(t *testing.T) {
+	now := time.Now()
+	st := &State{
+		CurrentItem: "current",
+		Items: map[string]*ItemState{
+			"current": {},
+			"old":     {},
+			"open":    {},
+		},
+		Files: map[string]*FileState{
+			"verified-gone.warc.gz":    {Item: "old", Status: FileVerified},
+			"uploaded-gone.warc.gz":    {Item: "old", Status: FileUploaded, UpdatedAt: now.Add(-2 * stateRetention)},
+			"recent-gone.warc.gz":      {Item: "open", Status: FileUploaded, UpdatedAt: now},
+			"verified-on-disk.warc.gz": {Item: "current", Status: FileVerified},
+			"failed-gone.warc.gz":      {Item: "open", Status: FileFailed},
+		},
+	}
+
+	pruned := st.prune(now, func(name string) bool {
+		return name == "verified-on-disk.warc.gz"
+	})
+	if !pruned {
+		t.Fatal("expected the state to be pruned")
+	}
+
+	for _, name := range []string{"recent-gone.warc.gz", "verified-on-disk.warc.gz", "failed-gone.warc.gz"} {
+		if st.Files[name] == nil {
+			t.Errorf("expected %s to be kept", name)
+		}
+	}
+	if len(st.Files) != 3 {
+		t.Errorf("expected the finished files that left the directory to be forgotten, got %v", st.Files)
+	}
+
+	if _, ok := st.Items["old"]; ok || len(st.Items) != 2 {
+		t.Errorf("expected only the items without files to be forgotten, got %v", st.Items)
+	}
+
+	if st.prune(now, func(string) bool { return true }) {
+		t.Error("expected nothing more to prune")
+	}
+}
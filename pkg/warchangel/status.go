@@ -0,0 +1,189 @@
+package warchangel
+
+import (
+	"sort"
+	"time"
+)
+
+// Status is a snapshot of what an Uploader is doing
+type Status struct {
+	// Running is true between the start of Run and the end of its shutdown
+	Running bool  `json:"running"`
+	Stats   Stats `json:"stats"`
+	// PausedUntil is when the uploads resume while they pause because archive.org asked to slow down
+	PausedUntil *time.Time  `json:"paused_until,omitempty"`
+	Jobs        []JobStatus `json:"jobs"`
+}
+
+// JobStatus is a snapshot of what a job is doing
+type JobStatus struct {
+	Job          string   `json:"job"`
+	WARCsDir     string   `json:"warcs"`
+	Roots        []string `json:"roots,omitempty"`
+	Collections  []string `json:"collections"`
+	ItemSize     int      `json:"item_size"`
+	ScanInterval int      `json:"scan_interval"`
+	// Threads and Order are the ones in use, they differ from the configuration under disk pressure
+	Threads      int         `json:"threads"`
+	Order        UploadOrder `json:"upload_order"`
+	DiskPressure bool        `json:"disk_pressure"`
+	// Throughput is the throughput of the job's uploads since it started
+	Throughput Throughput `json:"throughput"`
+	// LastScan is when the WARCs directory was last scanned, nil before the first scan
+	LastScan *time.Time `json:"last_scan,omitempty"`
+	// Files are the files queued or being uploaded, by name
+	Files     []FileProgress `json:"files"`
+	OpenItems []ItemStatus   `json:"open_items"`
+	// Failed are the files waiting for a retry, by name
+	Failed []FailedFile `json:"failed"`
+	// Error is why the state couldn't be loaded, the open items and failed files are then unknown
+	Error string `json:"error,omitempty"`
+}
+
+// FileProgress is a file queued or being uploaded
+type FileProgress struct {
+	File   string     `json:"file"`
+	Item   string     `json:"item"`
+	Size   int64      `json:"size"`
+	Status FileStatus `json:"status"`
+	// Sent is the number of bytes of the file read by the backend so far
+	Sent    int64   `json:"sent"`
+	Percent float64 `json:"percent"`
+	// BytesPerSecond is the average rate since the file was handed to the backend, and ETA how
+	// long sending the rest of the file takes at that rate
+	BytesPerSecond float64       `json:"bytes_per_second,omitempty"`
+	ETA            time.Duration `json:"eta,omitempty"`
+	// Stalled is true when no byte was sent for the job's stall_after delay
+	Stalled  bool       `json:"stalled,omitempty"`
+	QueuedAt time.Time  `json:"queued_at"`
+	Started  *time.Time `json:"started,omitempty"`
+}
+
+// ItemStatus is an item still being filled, or with files that aren't uploaded yet
+type ItemStatus struct {
+	Item  string `json:"item"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+	// Current is true for the item new files are packed into
+	Current bool `json:"current"`
+	// Uploading is the number of uploads into the item in progress
+	Uploading int `json:"uploading"`
+	// Throughput is the throughput of the item's uploads since the job started, nil if none was sent
+	Throughput *Throughput `json:"throughput,omitempty"`
+}
+
+// FailedFile is a file whose upload failed, see the retry command
+type FailedFile struct {
+	File      string    `json:"file"`
+	Item      string    `json:"item"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Ready reports whether the Uploader is running and accepting files
+func (u *Uploader) Ready() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.running && !u.stopped
+}
+
+// Status returns a snapshot of the jobs of the Uploader, with their files in progress and
+// the open items and failed files of their state
+func (u *Uploader) Status() Status {
+	u.mu.Lock()
+	status := Status{Running: u.running}
+	jobs := make([]*job, 0, len(u.jobs))
+	for _, j := range u.jobs {
+		jobs = append(jobs, j)
+	}
+	u.mu.Unlock()
+
+	status.Stats = u.Stats()
+	if until := u.slowDown.paused(time.Now()); !until.IsZero() {
+		status.PausedUntil = &until
+	}
+
+	files := make(map[string][]FileProgress)
+	u.inProgress.Range(func(_, value any) bool {
+		p := value.(*fileProgress)
+		files[p.job] = append(files[p.job], p.snapshot())
+		return true
+	})
+
+	for _, j := range jobs {
+		status.Jobs = append(status.Jobs, j.status(files))
+	}
+
+	sort.Slice(status.Jobs, func(a, b int) bool {
+		return status.Jobs[a].Job < status.Jobs[b].Job
+	})
+
+	return status
+}
+
+// status returns a snapshot of the job, with its files among the files in progress of every job
+func (j *job) status(files map[string][]FileProgress) JobStatus {
+	j.mu.RLock()
+	c := j.config
+	status := JobStatus{
+		Job:          c.Job,
+		WARCsDir:     c.WARCsDir,
+		Roots:        c.Roots,
+		Collections:  c.Collections,
+		ItemSize:     c.ItemSize,
+		ScanInterval: c.ScanInterval,
+		Threads:      j.pool.Size(),
+		Order:        j.pending.order(),
+		DiskPressure: j.diskPressure,
+		Files:        files[c.Job],
+		OpenItems:    []ItemStatus{},
+		Failed:       []FailedFile{},
+	}
+	if !j.lastScan.IsZero() {
+		lastScan := j.lastScan
+		status.LastScan = &lastScan
+	}
+	j.mu.RUnlock()
+
+	var items map[string]Throughput
+	status.Throughput, items = j.throughput.snapshot()
+	uploading := j.items.uploading()
+
+	if status.Files == nil {
+		status.Files = []FileProgress{}
+	}
+	sort.Slice(status.Files, func(a, b int) bool {
+		return status.Files[a].File < status.Files[b].File
+	})
+
+	err := j.state.View(func(st *State) {
+		for _, item := range st.OpenItems() {
+			itemStatus := ItemStatus{Item: item, Current: item == st.CurrentItem, Uploading: uploading[item]}
+			if i := st.Items[item]; i != nil {
+				itemStatus.Size, itemStatus.Files = i.Size, i.Files
+			}
+			if throughput, ok := items[item]; ok {
+				itemStatus.Throughput = &throughput
+			}
+			status.OpenItems = append(status.OpenItems, itemStatus)
+		}
+
+		for _, name := range st.FilesWithStatus(FileFailed) {
+			f := st.Files[name]
+			status.Failed = append(status.Failed, FailedFile{
+				File:      name,
+				Item:      f.Item,
+				Error:     f.Error,
+				Attempts:  f.Attempts,
+				UpdatedAt: f.UpdatedAt,
+			})
+		}
+	})
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	return status
+}
@@ -0,0 +1,167 @@
+package warchangel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pausingBackend reads the first bytes of each upload, then waits to be released
+type pausingBackend struct {
+	read    int64
+	started chan string
+	release chan struct{}
+}
+
+func (b *pausingBackend) Put(ctx context.Context, upload *Upload) (string, error) {
+	if _, err := io.CopyN(io.Discard, upload.Body, b.read); err != nil {
+		return "", err
+	}
+
+	b.started <- upload.Filename
+
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if _, err := io.Copy(io.Discard, upload.Body); err != nil {
+		return "", err
+	}
+
+	return upload.Item + "/" + upload.Filename, nil
+}
+
+func TestHandlerStatus(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.Threads = 1
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 400,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": 600,
+		"WEB-20240109170600000-00001-other.local.warc.gz":   100,
+	})
+
+	store := NewStateStore(DefaultStatePath(c))
+	if err := store.Update(func(st *State) bool {
+		f := st.SetFile("WEB-20240109170600000-00001-other.local.warc.gz", FileFailed, errors.New("connection reset"))
+		f.Item, f.Size, f.Attempts = "WEB-20240109170600-other", 100, 3
+		st.Items["WEB-20240109170600-other"] = &ItemState{Size: 100, Files: 1}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &pausingBackend{read: 100, started: make(chan string, 2), release: make(chan struct{})}
+	u, err := New(Options{
+		Jobs:    []*Config{c},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend: backend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(u.StatusHandler())
+	defer server.Close()
+
+	get := func(path string, expectedStatus int, v any) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("GET %s: expected status %d, got %d", path, expectedStatus, resp.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	get("/healthz", http.StatusOK, nil)
+	get("/readyz", http.StatusServiceUnavailable, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		close(backend.release)
+		cancel()
+		<-stopped
+	}()
+
+	for _, name := range []string{"WEB-20240109170659538-00001-endgame.local.warc.gz", "WEB-20240109170700000-00002-endgame.local.warc.gz"} {
+		if _, err := u.Submit(filepath.Join(c.WARCsDir, name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The submitted files race for the single upload slot
+	var started string
+	select {
+	case started = <-backend.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an upload to start")
+	}
+
+	get("/readyz", http.StatusOK, nil)
+
+	var status Status
+	get("/status", http.StatusOK, &status)
+
+	if !status.Running || len(status.Jobs) != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	job := status.Jobs[0]
+	if job.Job != "test" || job.WARCsDir != c.WARCsDir || job.Threads != 1 || job.Order != OrderName || job.LastScan != nil {
+		t.Errorf("unexpected job status %+v", job)
+	}
+
+	if len(job.Files) != 2 {
+		t.Fatalf("expected 2 files in progress, got %+v", job.Files)
+	}
+	uploading, queued := job.Files[0], job.Files[1]
+	if uploading.File != started {
+		uploading, queued = queued, uploading
+	}
+	if uploading.Status != FileUploading || uploading.Sent != 100 || uploading.Percent != percent(100, uploading.Size) ||
+		uploading.BytesPerSecond <= 0 || uploading.Started == nil {
+		t.Errorf("unexpected uploading file %+v", uploading)
+	}
+	if queued.Status != FileQueued || queued.Sent != 0 || queued.Started != nil {
+		t.Errorf("unexpected queued file %+v", queued)
+	}
+
+	if len(job.OpenItems) != 2 || job.OpenItems[0].Item != "WEB-20240109170600-other" || job.OpenItems[0].Size != 100 ||
+		job.OpenItems[0].Throughput != nil || job.OpenItems[1].Item != "WEB-20240109170659-endgame" ||
+		!job.OpenItems[1].Current || job.OpenItems[1].Files != 2 || job.OpenItems[1].Throughput == nil {
+		t.Errorf("unexpected open items %+v", job.OpenItems)
+	}
+
+	if job.Throughput.Bytes != 100 || job.Throughput.Files != 0 {
+		t.Errorf("unexpected throughput %+v", job.Throughput)
+	}
+
+	if len(job.Failed) != 1 || job.Failed[0].Error != "connection reset" || job.Failed[0].Attempts != 3 {
+		t.Errorf("unexpected failed files %+v", job.Failed)
+	}
+}
@@ -2,48 +2,293 @@ package warchangel
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
-	"path"
+	"path/filepath"
+	"time"
+)
+
+// maxRetryDelay caps the delay before a file is queued again after a failed upload
+const maxRetryDelay = time.Hour
+
+// retryDelay returns how long a file waits before it is queued again after its retry-th failed
+// upload, doubling with each retry
+func (c *Config) retryDelay(retry int) time.Duration {
+	delay := 60 * time.Second
+	if c.RetryDelay > 0 {
+		delay = time.Duration(c.RetryDelay) * time.Second
+	}
+
+	for ; retry > 1 && delay < maxRetryDelay; retry-- {
+		delay *= 2
+	}
+
+	return min(delay, maxRetryDelay)
+}
+
+// maxRetries returns the number of times a file is queued again after a failed upload before it fails
+func (c *Config) maxRetries() int {
+	if c.MaxRetries > 0 {
+		return c.MaxRetries
+	}
+
+	return 3
+}
+
+// isRetryable reports whether a failed upload may go through if tried again later, unlike the
+// files that are broken or can't be read, and the files archive.org asked to slow down too often
+func isRetryable(err error) bool {
+	if isSlowDown(err) {
+		return false
+	}
+
+	switch errorClass(err) {
+	case errorClassTimeout, errorClassBackend:
+		return true
+	}
 
-	"github.com/remeh/sizedwaitgroup"
+	return false
+}
+
+// uploadOutcome is what happened to a file after an attempt to upload it
+type uploadOutcome int
+
+const (
+	uploadEnded      uploadOutcome = iota // the file was uploaded, failed or was left queued
+	uploadSlowedDown                      // archive.org asked to slow down, the file waits for the uploads to resume
+	uploadRetried                         // the upload failed, the file is queued again after the retry delay
 )
 
-func uploadFile(filename string, item string, wg *sizedwaitgroup.SizedWaitGroup) {
-	defer wg.Done()
+// uploadFile uploads a file of the job with the configuration it was queued with,
+// and releases the upload slots taken by startQueued. The upload is aborted when ctx is
+// done, the file is then queued again so that it's uploaded on the next start. When
+// archive.org asks to slow down, the file is queued again as well, and keeps its
+// slots until the uploads resume. A file whose upload timed out or failed to be sent
+// releases its slots and is queued again after the retry delay.
+func (j *job) uploadFile(ctx context.Context, c *Config, file queuedFile, release func(uploaded bool)) {
+	defer j.pool.Done()
+	defer j.u.uploads.Done()
+	defer j.items.end(file.item)
+
+	for {
+		switch j.tryUpload(ctx, c, file, release) {
+		case uploadSlowedDown:
+			var ok bool
+			if release, ok = j.u.slowDown.acquire(j.done); !ok {
+				j.logger.Info("job stopped, leaving file queued", "file", file.name, "item", file.item)
+				j.u.inProgress.Delete(filepath.Join(c.WARCsDir, file.name))
+				j.u.dequeue(c.Job, 1)
+				return
+			}
+		case uploadRetried:
+			file.retries++
+			j.retryLater(c, file, c.retryDelay(file.retries))
+			return
+		default:
+			j.u.inProgress.Delete(filepath.Join(c.WARCsDir, file.name))
+			return
+		}
+	}
+}
 
-	UploadsInProgress.Store(filename, item)
+// retryLater queues the file again once the delay is over, or leaves it queued for the next
+// start if the job stops before
+func (j *job) retryLater(c *Config, file queuedFile, delay time.Duration) {
+	j.retries.Add(1)
+	go func() {
+		defer j.retries.Done()
 
-	logger.Info("uploading file", "file", filename, "item", item)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			j.enqueue(c, file)
+		case <-j.done:
+			j.logger.Info("job stopped, leaving file queued", "file", file.name, "item", file.item)
+			j.u.inProgress.Delete(filepath.Join(c.WARCsDir, file.name))
+			j.u.dequeue(c.Job, 1)
+		}
+	}()
+}
 
-	// Init Internet Archive S3 client
-	fs, err := initRcloneFS(filename, item)
+// tryUpload uploads the file once, calls release with the outcome, and reports whether the
+// file was queued again because archive.org asked to slow down or to retry it later
+func (j *job) tryUpload(ctx context.Context, c *Config, file queuedFile, release func(uploaded bool)) uploadOutcome {
+	event := Event{Job: c.Job, File: file.name, Item: file.item, Size: file.size}
+
+	j.logger.Info("uploading file", "file", file.name, "item", file.item)
+	file.progress.start()
+	event.Status, event.Attempt = FileUploading, j.setFileStatus(file.name, FileUploading, nil)
+	j.u.emit(event)
+
+	started := time.Now()
+	remote, err := j.putFile(ctx, c, file)
+	event.Duration = time.Since(started)
+	release(err == nil)
+	if err != nil && ctx.Err() != nil {
+		j.logger.Warn("upload aborted, the file will be uploaded again", "file", file.name, "item", file.item, "err", err)
+		j.setFileStatus(file.name, FileQueued, err)
+		event.Status, event.Err = FileQueued, classify(errorClassAborted, err)
+		j.u.emit(event)
+		return uploadEnded
+	}
+	if isSlowDown(err) && j.pause(c, file, err) {
+		j.setFileStatus(file.name, FileQueued, err)
+		event.Status, event.Err = FileQueued, classify(errorClassSlowDown, err)
+		j.u.emit(event)
+		file.progress.requeue()
+		return uploadSlowedDown
+	}
+	if isRetryable(err) && file.retries < c.maxRetries() {
+		delay := c.retryDelay(file.retries + 1)
+		j.logger.Warn("unable to upload file, retrying later", "file", file.name, "item", file.item,
+			"retry", file.retries+1, "delay", delay, "err", err)
+		j.setFileStatus(file.name, FileQueued, err)
+		event.Status, event.Err = FileQueued, err
+		j.u.emit(event)
+		file.progress.requeue()
+		return uploadRetried
+	}
 	if err != nil {
-		logger.Error("unable to init rclone FS", "err", err)
-		panic(err)
+		j.logger.Error("unable to upload file", "file", file.name, "item", file.item, "err", err)
+		j.setFileStatus(file.name, FileFailed, err)
+		event.Status, event.Err = FileFailed, err
+		j.u.emit(event)
+		return uploadEnded
 	}
 
-	// Open file
-	file, err := os.Open(path.Join(config.WARCsDir, filename))
+	j.items.markCreated(file.item)
+	j.setFileStatus(file.name, FileUploaded, nil)
+	event.Status, event.Remote = FileUploaded, remote
+	j.u.emit(event)
+
+	jobThroughput, items := j.throughput.snapshot()
+	j.logger.Info("finished uploading file", "file", file.name, "item", file.item, "path", remote,
+		"mbps", megabytes(file.progress.rate(time.Now())),
+		"item-mbps", megabytes(items[file.item].BytesPerSecond),
+		"job-mbps", megabytes(jobThroughput.BytesPerSecond))
+
+	return uploadEnded
+}
+
+// remoteName returns the name a file is uploaded under in its item, its base name whatever the
+// directory it was found in
+func remoteName(name string) string {
+	return filepath.Base(name)
+}
+
+func (j *job) putFile(ctx context.Context, c *Config, queued queuedFile) (remote string, err error) {
+	filename := queued.name
+	fullPath := c.filePath(filename)
+
+	// Check the file before sending it anywhere
+	md5sum, err := checkIntegrity(ctx, c, fullPath)
+	if err != nil {
+		return "", classify(errorClassIntegrity, err)
+	}
+
+	metadata, err := buildItemMetadata(c, filename)
 	if err != nil {
-		logger.Error("unable to open file", "err", err)
-		return
+		return "", classify(errorClassMetadata, err)
+	}
+
+	for key, values := range queued.metadata {
+		metadata[key] = append(metadata[key], values...)
+	}
+
+	// archive.org only applies the metadata sent with a file when it creates the item, the
+	// metadata submitted with the files of existing items is added once they are uploaded
+	updateMetadata := len(queued.metadata) > 0 && j.items.isCreated(queued.item)
+	updater, ok := j.u.backend.(MetadataBackend)
+	if updateMetadata && !ok {
+		return "", classify(errorClassMetadata, fmt.Errorf("the backend can't add the submitted metadata to the existing item %s", queued.item))
 	}
 
-	// Upload file
-	object, err := fs.NewObject(context.Background(), filename)
+	// Open file
+	file, err := os.Open(fullPath)
 	if err != nil {
-		logger.Error("unable to create new object", "err", err)
-		return
+		return "", classify(errorClassIO, fmt.Errorf("unable to open file: %w", err))
 	}
+	defer file.Close()
 
-	object, err = fs.Put(context.Background(), file, object, nil)
+	info, err := file.Stat()
 	if err != nil {
-		logger.Error("unable to upload file", "err", err)
-		return
+		return "", classify(errorClassIO, fmt.Errorf("unable to stat file: %w", err))
+	}
+
+	// Upload file, within the job's timeouts
+	sendCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if c.UploadTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		sendCtx, cancelTimeout = context.WithTimeoutCause(sendCtx, time.Duration(c.UploadTimeout)*time.Second,
+			fmt.Errorf("not uploaded within %ds: %w", c.UploadTimeout, ErrUploadTimeout))
+		defer cancelTimeout()
 	}
 
-	// Once done, remove from inProgress
-	UploadsInProgress.Delete(filename)
+	// Checked by Validate
+	uploadTimetable, _ := parseBandwidthLimit(c.UploadBandwidthLimit)
+
+	queued.progress.send()
+	stopProgress := j.watchProgress(c, queued.progress, cancel)
+	remote, err = j.u.backend.Put(sendCtx, &Upload{
+		Item:     queued.item,
+		Filename: remoteName(filename),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		MD5:      md5sum,
+		Metadata: metadata,
+		Derive:   intToBool(c.Derive),
+		Body: &contextReader{ctx: sendCtx, r: &throttledReader{
+			ctx:      sendCtx,
+			r:        &progressReader{progress: queued.progress, r: file},
+			limiters: []*bandwidthLimiter{newBandwidthLimiter(uploadTimetable), j.bandwidth, j.u.bandwidth},
+		}},
+	})
+	stopProgress()
+	queued.progress.finish(err == nil)
+
+	if latency, ok := queued.progress.latency(); ok {
+		j.concurrency.observeLatency(latency)
+	}
+	if isSlowDown(err) {
+		j.concurrency.slowDown()
+	}
+
+	// The backend only sees the cancellation, not why the upload timed out
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(sendCtx), ErrUploadTimeout) {
+		return "", classify(errorClassTimeout, context.Cause(sendCtx))
+	}
+
+	if errors.Is(err, ErrUnsupportedUpload) {
+		return "", classify(errorClassMetadata, err)
+	}
+
+	if err == nil && updateMetadata {
+		if err := updater.UpdateMetadata(ctx, queued.item, queued.metadata); err != nil {
+			return "", classify(errorClassMetadata, err)
+		}
+	}
+
+	return remote, classify(errorClassBackend, err)
+}
+
+// setFileStatus records the new status of a file in the job's state, and returns the
+// number of times its upload was attempted
+func (j *job) setFileStatus(filename string, status FileStatus, cause error) (attempts int) {
+	err := j.state.Update(func(st *State) bool {
+		f := st.SetFile(filename, status, cause)
+		if status == FileUploading {
+			f.Attempts++
+		}
+		attempts = f.Attempts
+		return true
+	})
+	if err != nil {
+		j.logger.Error("unable to update state", "file", filename, "status", status, "err", err)
+	}
 
-	logger.Info("finished uploading file", "file", filename, "item", item, "path", object.Remote())
+	return attempts
 }
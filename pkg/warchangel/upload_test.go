@@ -2,7 +2,15 @@
 package warchangel
 
 import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetItemName(t *testing.T) {
@@ -19,7 +27,7 @@ func TestGetItemName(t *testing.T) {
 			config: &Config{
 				WARCNaming: ZenoWARCNaming,
 			},
-			expected:    "WEB-20240109170659-endgame.local",
+			expected:    "WEB-20240109170659-endgame",
 			expectError: false,
 		},
 		{
@@ -28,7 +36,7 @@ func TestGetItemName(t *testing.T) {
 			config: &Config{
 				WARCNaming: HeritrixWARCNaming,
 			},
-			expected:    "WEB-20240109170659-endgame.local",
+			expected:    "WEB-20240109170659-endgame",
 			expectError: false,
 		},
 		{
@@ -58,7 +66,7 @@ func TestGetItemName(t *testing.T) {
 			config: &Config{
 				WARCNaming: ZenoWARCNaming,
 			},
-			expected:    "API-20231231235959-service.local",
+			expected:    "API-20231231235959-service",
 			expectError: false,
 		},
 		{
@@ -67,14 +75,14 @@ func TestGetItemName(t *testing.T) {
 			config: &Config{
 				WARCNaming: HeritrixWARCNaming,
 			},
-			expected:    "IMG-20230515123045-imageserver.local",
+			expected:    "IMG-20230515123045-imageserver",
 			expectError: false,
 		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			itemName, err := getItemName(tc.filename)
+			itemName, err := getItemName(tc.config.WARCNaming, tc.filename)
 
 			if tc.expectError {
 				if err == nil {
@@ -91,3 +99,244 @@ func TestGetItemName(t *testing.T) {
 		})
 	}
 }
+
+func TestPutFileTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   func(c *Config)
+		abort    bool
+		expected string
+	}{
+		{
+			name:     "upload timeout",
+			config:   func(c *Config) { c.UploadTimeout = 1 },
+			expected: "not uploaded within 1s: upload timed out",
+		},
+		{
+			name:     "inactivity timeout",
+			config:   func(c *Config) { c.InactivityTimeout = 1 },
+			expected: "no bytes sent for 1s: upload timed out",
+		},
+		{
+			// An upload aborted at shutdown didn't time out, whatever the timeouts
+			name:     "aborted",
+			config:   func(c *Config) { c.UploadTimeout = 60 },
+			abort:    true,
+			expected: context.Canceled.Error(),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testJobConfig(t, "test")
+			tc.config(c)
+			name := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+			writeWARCs(t, c.WARCsDir, map[string]int{name: 600})
+
+			backend := &blockingBackend{started: make(chan string, 1)}
+			u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Backend: backend})
+			j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.abort {
+				go func() {
+					<-backend.started
+					cancel()
+				}()
+			}
+
+			item := "WEB-20240109170659-endgame"
+			_, err := j.putFile(ctx, c, queuedFile{name: name, item: item, size: 600, progress: newFileProgress(c.Job, name, item, 600, j.throughput)})
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("expected the error %q, got %v", tc.expected, err)
+			}
+
+			if timedOut := errors.Is(err, ErrUploadTimeout); timedOut == tc.abort || (errorClass(err) == errorClassTimeout) != timedOut {
+				t.Errorf("unexpected error class %s for %v", errorClass(err), err)
+			}
+		})
+	}
+}
+
+func TestJobStartWithoutSlots(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.Threads = 1
+	names := []string{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz",
+		"WEB-20240109170700000-00002-endgame.local.warc.gz",
+		"WEB-20240109170800000-00003-endgame.local.warc.gz",
+	}
+	writeWARCs(t, c.WARCsDir, map[string]int{names[0]: 100, names[1]: 100, names[2]: 100})
+
+	backend := &pausingBackend{started: make(chan string, 3), release: make(chan struct{})}
+	u := newUploader(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Backend: backend})
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+	j.startDispatcher()
+
+	// Queuing files never waits for an upload slot, the dispatcher does
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		for _, name := range names {
+			if _, err := j.submit(name, nil); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the files to be queued while the upload slot is taken")
+	}
+
+	select {
+	case <-backend.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first upload to start")
+	}
+
+	// The dispatcher waiting for the slot stops with the job, while the upload goes on
+	j.stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		j.dispatcher.Wait()
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the dispatcher to stop without waiting for the upload slot")
+	}
+
+	close(backend.release)
+	j.pool.Wait()
+
+	for _, name := range names[1:] {
+		if _, ok := u.inProgress.Load(filepath.Join(c.WARCsDir, name)); ok {
+			t.Errorf("expected %s to be left queued for the next start", name)
+		}
+	}
+}
+
+// failingBackend fails the first uploads it receives
+type failingBackend struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (b *failingBackend) Put(ctx context.Context, upload *Upload) (string, error) {
+	if _, err := io.Copy(io.Discard, upload.Body); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures > 0 {
+		b.failures--
+		return "", errors.New("connection reset by peer")
+	}
+
+	return upload.Item + "/" + upload.Filename, nil
+}
+
+func TestUploadRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		expected []FileStatus
+		stats    Stats
+	}{
+		{
+			name:     "retried after the delay",
+			failures: 1,
+			expected: []FileStatus{FileQueued, FileUploading, FileQueued, FileUploading, FileUploaded},
+			stats:    Stats{Uploaded: 1, UploadedBytes: 600},
+		},
+		{
+			name:     "max retries",
+			failures: 2,
+			expected: []FileStatus{FileQueued, FileUploading, FileQueued, FileUploading, FileFailed},
+			stats:    Stats{Failed: 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testJobConfig(t, "test")
+			c.RetryDelay = 1
+			c.MaxRetries = 1
+			name := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+			writeWARCs(t, c.WARCsDir, map[string]int{name: 600})
+
+			var (
+				mu     sync.Mutex
+				events []Event
+				ended  = make(chan struct{})
+			)
+			u := newUploader(Options{
+				Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Backend: &failingBackend{failures: tc.failures},
+				OnEvent: func(e Event) {
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, e)
+					if e.Status == FileUploaded || e.Status == FileFailed {
+						close(ended)
+					}
+				},
+			})
+			j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+			j.startDispatcher()
+
+			started := time.Now()
+			if _, err := j.submit(name, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-ended:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the upload to end")
+			}
+			j.stop()
+			j.dispatcher.Wait()
+			j.retries.Wait()
+			j.pool.Wait()
+
+			// The upload slot is free while the file waits for its retry
+			if elapsed := time.Since(started); elapsed < time.Second {
+				t.Errorf("expected the retry to wait for the retry delay, took %s", elapsed)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) != len(tc.expected) {
+				t.Fatalf("expected %d events, got %+v", len(tc.expected), events)
+			}
+			for i, e := range events {
+				if e.Status != tc.expected[i] {
+					t.Errorf("event %d: expected %s, got %+v", i, tc.expected[i], e)
+				}
+			}
+			if class := errorClass(events[2].Err); class != errorClassBackend {
+				t.Errorf("expected the file to be queued again because of the backend error, got %s", class)
+			}
+
+			if stats := u.Stats(); stats != tc.stats {
+				t.Errorf("expected the stats %+v, got %+v", tc.stats, stats)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := &Config{RetryDelay: 600}
+
+	for retry, expected := range map[int]time.Duration{1: 10 * time.Minute, 2: 20 * time.Minute, 3: 40 * time.Minute, 4: time.Hour, 30: time.Hour} {
+		if delay := c.retryDelay(retry); delay != expected {
+			t.Errorf("retry %d: expected a delay of %s, got %s", retry, expected, delay)
+		}
+	}
+}
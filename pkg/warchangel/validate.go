@@ -0,0 +1,255 @@
+package warchangel
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Defaults for the optional configuration values
+const (
+	DefaultScanInterval = 60 // seconds
+	DefaultItemSize     = 10 // gigabytes
+	DefaultThreads      = 4
+	DefaultItemThreads  = 2
+)
+
+var (
+	identifierRegexp  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	metadataKeyRegexp = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+)
+
+// FieldError is a problem with a configuration field, Field is the path of the field
+// using the configuration's keys, e.g. collections[1]
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError is returned for an invalid configuration, it holds every problem found
+type ValidationError struct {
+	Problems []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.String()
+	}
+
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+// SetDefaults fills the optional values that aren't set
+func (c *Config) SetDefaults() {
+	if c.Version == 0 {
+		c.Version = ConfigVersion
+	}
+
+	if c.ScanInterval == 0 {
+		c.ScanInterval = DefaultScanInterval
+	}
+
+	if c.ItemSize == 0 {
+		c.ItemSize = DefaultItemSize
+	}
+
+	if c.Threads == 0 {
+		c.Threads = DefaultThreads
+	}
+
+	// 0 is kept, it lifts the limit
+	if c.ItemThreads == nil {
+		itemThreads := DefaultItemThreads
+		c.ItemThreads = &itemThreads
+	}
+}
+
+// Validate checks the configuration and returns a *ValidationError
+// listing every problem found, or nil if the configuration is valid
+func (c *Config) Validate() error {
+	var problems []FieldError
+
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Version < 0 || c.Version > ConfigVersion {
+		add("version", "unsupported configuration version %d, this warchangel supports version %d", c.Version, ConfigVersion)
+	}
+
+	if c.Job == "" {
+		add("job", "must be set")
+	}
+
+	if c.WARCsDir == "" {
+		add("warcs", "must be set")
+	}
+
+	// A file under nested roots would be tracked under two names
+	roots := c.roots()
+	for i, root := range c.Roots {
+		if root == "" {
+			add(fmt.Sprintf("roots[%d]", i), "must be set")
+			continue
+		}
+
+		for j, other := range roots[:i+1] {
+			if other == "" {
+				continue
+			}
+
+			rel, err := filepath.Rel(filepath.Clean(other), filepath.Clean(root))
+			if err == nil && filepath.IsLocal(rel) {
+				add(fmt.Sprintf("roots[%d]", i), "must not be under %s", rootField(j))
+			} else if rel, err = filepath.Rel(filepath.Clean(root), filepath.Clean(other)); err == nil && filepath.IsLocal(rel) {
+				add(fmt.Sprintf("roots[%d]", i), "must not hold %s", rootField(j))
+			}
+		}
+	}
+
+	for i, pattern := range c.Include {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("include[%d]", i), "invalid glob pattern: %v", err)
+		} else if !filepath.IsLocal(pattern) {
+			add(fmt.Sprintf("include[%d]", i), "must be relative to the roots and stay under them, list the other directories in roots")
+		}
+	}
+
+	for i, pattern := range c.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("exclude[%d]", i), "invalid glob pattern: %v", err)
+		}
+	}
+
+	if c.ScanInterval < 0 {
+		add("scan_interval", "must be a positive number of seconds, got %d", c.ScanInterval)
+	}
+
+	if c.StabilityWait < 0 {
+		add("stability_wait", "must be a positive number of seconds, got %d", c.StabilityWait)
+	}
+
+	if c.ItemSize < 0 {
+		add("item_size", "must be a positive number of gigabytes, got %d", c.ItemSize)
+	}
+
+	if c.Threads < 0 {
+		add("threads", "must be a positive number of parallel uploads, got %d", c.Threads)
+	}
+
+	if c.ItemThreads != nil && *c.ItemThreads < 0 {
+		add("item_threads", "must be a positive number of parallel uploads, got %d", *c.ItemThreads)
+	}
+
+	if c.MinThreads < 0 {
+		add("min_threads", "must be a positive number of parallel uploads, got %d", c.MinThreads)
+	}
+
+	if c.MaxThreads < 0 || (c.MaxThreads > 0 && c.MaxThreads < c.MinThreads) {
+		add("max_threads", "must be a positive number of parallel uploads, at least min_threads, got %d", c.MaxThreads)
+	}
+
+	switch c.WARCNaming {
+	case ZenoWARCNaming, HeritrixWARCNaming:
+	default:
+		add("warc_naming", "unknown WARC naming convention %d, must be %d (Zeno) or %d (Heritrix)", c.WARCNaming, ZenoWARCNaming, HeritrixWARCNaming)
+	}
+
+	if len(c.Collections) == 0 {
+		add("collections", "at least one collection is required")
+	}
+
+	for i, collection := range c.Collections {
+		if !identifierRegexp.MatchString(collection) {
+			add(fmt.Sprintf("collections[%d]", i), "%q is not a valid collection identifier", collection)
+		}
+	}
+
+	for _, key := range ItemMetadata(c.Metadata).keys() {
+		if !metadataKeyRegexp.MatchString(key) {
+			add("subject."+key, "metadata keys must be lowercase letters, digits, - or _")
+		}
+	}
+
+	if c.DiskHighWater < 0 || c.DiskHighWater > 100 {
+		add("disk_high_water", "must be a percentage of the disk usage, got %d", c.DiskHighWater)
+	}
+
+	if c.DiskLowWater < 0 || (c.DiskLowWater > 0 && c.DiskLowWater >= c.DiskHighWater) {
+		add("disk_low_water", "must be a percentage of the disk usage lower than disk_high_water, got %d", c.DiskLowWater)
+	}
+
+	if c.DiskPressureThreads < 0 {
+		add("disk_pressure_threads", "must be a positive number of parallel uploads, got %d", c.DiskPressureThreads)
+	}
+
+	if c.ProgressInterval < 0 {
+		add("progress_interval", "must be a positive number of seconds, got %d", c.ProgressInterval)
+	}
+
+	if c.StallAfter < 0 {
+		add("stall_after", "must be a positive number of seconds, got %d", c.StallAfter)
+	}
+
+	if c.UploadTimeout < 0 {
+		add("upload_timeout", "must be a positive number of seconds, got %d", c.UploadTimeout)
+	}
+
+	if c.InactivityTimeout < 0 {
+		add("inactivity_timeout", "must be a positive number of seconds, got %d", c.InactivityTimeout)
+	}
+
+	if c.BlockDelay < 0 {
+		add("block_delay", "must be a positive number of seconds, got %d", c.BlockDelay)
+	}
+
+	if c.RetryDelay < 0 {
+		add("retry_delay", "must be a positive number of seconds, got %d", c.RetryDelay)
+	}
+
+	if c.MaxRetries < 0 {
+		add("max_retries", "must be a positive number of retries, got %d", c.MaxRetries)
+	}
+
+	if c.MaxBlockCount < 0 {
+		add("max_block_count", "must be a positive number of pauses, got %d", c.MaxBlockCount)
+	}
+
+	if _, err := parseBandwidthLimit(c.BandwidthLimit); err != nil {
+		add("bwlimit", "invalid bandwidth limit: %v", err)
+	}
+
+	if _, err := parseBandwidthLimit(c.UploadBandwidthLimit); err != nil {
+		add("upload_bwlimit", "invalid bandwidth limit: %v", err)
+	}
+
+	if c.Order != "" && !slices.Contains(uploadOrders, c.Order) {
+		add("upload_order", "unknown upload order %q, must be one of %v", c.Order, uploadOrders)
+	}
+
+	if c.Derive != 0 && c.Derive != 1 {
+		add("derive", "must be 0 or 1, got %d", c.Derive)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+// rootField returns the configuration field of the i-th root of a job, WARCsDir being the first
+func rootField(i int) string {
+	if i == 0 {
+		return "warcs"
+	}
+
+	return fmt.Sprintf("roots[%d]", i-1)
+}
@@ -0,0 +1,182 @@
+package warchangel
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// metadataEndpoint is the Internet Archive metadata API
+var metadataEndpoint = "https://archive.org/metadata"
+
+// VerifyResult is the outcome of comparing a local WARC file with its uploaded copy
+type VerifyResult struct {
+	File       string `json:"file"`
+	Item       string `json:"item"`
+	LocalSize  int64  `json:"local_size"`
+	RemoteSize int64  `json:"remote_size"`
+	LocalMD5   string `json:"local_md5,omitempty"`
+	RemoteMD5  string `json:"remote_md5,omitempty"`
+	Verified   bool   `json:"verified"`
+	// Mismatch is set when the remote copy exists but differs from the local file
+	Mismatch bool   `json:"mismatch"`
+	Error    string `json:"error,omitempty"`
+}
+
+type remoteFile struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// Verify compares the given files (or every uploaded file if none is given) with the
+// files present in their items on archive.org, using their size and MD5 checksum.
+// Files that match are marked as verified in the state, files that differ are marked
+// as failed so that they can be retried. Files that don't appear in their item yet
+// are left untouched, the item may simply not be processed yet.
+func Verify(ctx context.Context, c *Config, l *slog.Logger, store *StateStore, files []string) ([]VerifyResult, error) {
+	st, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		files = st.FilesWithStatus(FileUploaded, FileVerified)
+	}
+
+	var (
+		results []VerifyResult
+		remotes = make(map[string]map[string]remoteFile)
+	)
+
+	for _, name := range files {
+		f, ok := st.Files[name]
+		if !ok {
+			results = append(results, VerifyResult{File: name, Error: "file is unknown to warchangel"})
+			continue
+		}
+
+		remote, ok := remotes[f.Item]
+		if !ok {
+			l.Debug("fetching item files", "item", f.Item)
+			remote, err = fetchItemFiles(ctx, f.Item)
+			if err != nil {
+				return nil, err
+			}
+			remotes[f.Item] = remote
+		}
+
+		results = append(results, verifyFile(c, name, f, remote))
+	}
+
+	err = store.Update(func(st *State) bool {
+		for _, result := range results {
+			switch {
+			case result.Verified:
+				st.SetFile(result.File, FileVerified, nil)
+			case result.Mismatch:
+				st.SetFile(result.File, FileFailed, errors.New(result.Error))
+			}
+		}
+		return true
+	})
+
+	return results, err
+}
+
+func verifyFile(c *Config, name string, f *FileState, remote map[string]remoteFile) VerifyResult {
+	result := VerifyResult{
+		File:      name,
+		Item:      f.Item,
+		LocalSize: f.Size,
+	}
+
+	r, ok := remote[remoteName(name)]
+	if !ok {
+		result.Error = "file not found in item"
+		return result
+	}
+
+	result.RemoteMD5 = r.MD5
+	result.RemoteSize, _ = strconv.ParseInt(r.Size, 10, 64)
+
+	// The local file may already be gone, in which case only what was recorded can be compared
+	result.LocalMD5 = f.MD5
+	if sum, size, err := md5File(c.filePath(name)); err == nil {
+		result.LocalMD5 = sum
+		result.LocalSize = size
+	} else if !errors.Is(err, os.ErrNotExist) {
+		result.Error = err.Error()
+		return result
+	}
+
+	switch {
+	case result.LocalSize != result.RemoteSize:
+		result.Mismatch = true
+		result.Error = fmt.Sprintf("size mismatch: local %d, remote %d", result.LocalSize, result.RemoteSize)
+	case result.LocalMD5 != "" && result.LocalMD5 != result.RemoteMD5:
+		result.Mismatch = true
+		result.Error = fmt.Sprintf("md5 mismatch: local %s, remote %s", result.LocalMD5, result.RemoteMD5)
+	default:
+		result.Verified = true
+	}
+
+	return result
+}
+
+// fetchItemFiles returns the files of an item indexed by name
+func fetchItemFiles(ctx context.Context, item string) (map[string]remoteFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataEndpoint+"/"+url.PathEscape(item), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch metadata of item %s: %w", item, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch metadata of item %s: %s", item, resp.Status)
+	}
+
+	var metadata struct {
+		Files []remoteFile `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("unable to decode metadata of item %s: %w", item, err)
+	}
+
+	files := make(map[string]remoteFile, len(metadata.Files))
+	for _, file := range metadata.Files {
+		files[file.Name] = file
+	}
+
+	return files, nil
+}
+
+func md5File(path string) (sum string, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	size, err = io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,96 @@
+package warchangel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	writeWARCs(t, dir, map[string]int{
+		"good.warc.gz":     100,
+		"bad.warc.gz":      100,
+		"missing.warc.gz":  100,
+		"truncate.warc.gz": 100,
+	})
+
+	// Files found under a directory of the root are uploaded under their base name
+	if err := os.MkdirAll(filepath.Join(dir, "launch", "warcs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeWARCs(t, filepath.Join(dir, "launch", "warcs"), map[string]int{"nested.warc.gz": 100})
+	nested := filepath.Join("launch", "warcs", "nested.warc.gz")
+
+	// MD5 of 100 zero bytes
+	const sum = "6d0bb00954ceb7fbee436bb55a8397a9"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/item" {
+			w.Write([]byte("{}"))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"files": []remoteFile{
+				{Name: "good.warc.gz", Size: "100", MD5: sum},
+				{Name: "bad.warc.gz", Size: "100", MD5: "d41d8cd98f00b204e9800998ecf8427e"},
+				{Name: "truncate.warc.gz", Size: "42", MD5: sum},
+				{Name: "nested.warc.gz", Size: "100", MD5: sum},
+			},
+		})
+	}))
+	defer server.Close()
+
+	endpoint := metadataEndpoint
+	metadataEndpoint = server.URL
+	defer func() { metadataEndpoint = endpoint }()
+
+	store := NewStateStore(filepath.Join(dir, "state.json"))
+	err := store.Update(func(st *State) bool {
+		for _, name := range []string{"good.warc.gz", "bad.warc.gz", "missing.warc.gz", "truncate.warc.gz", nested} {
+			f := st.SetFile(name, FileUploaded, nil)
+			f.Item = "item"
+			f.Size = 100
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{WARCsDir: dir}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	results, err := Verify(context.Background(), c, l, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+
+	st, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]FileStatus{
+		"good.warc.gz":     FileVerified,
+		"bad.warc.gz":      FileFailed,
+		"missing.warc.gz":  FileUploaded,
+		"truncate.warc.gz": FileFailed,
+		nested:             FileVerified,
+	}
+	for name, status := range expected {
+		if st.Files[name].Status != status {
+			t.Errorf("expected %s to be %s, got %s (%s)", name, status, st.Files[name].Status, st.Files[name].Error)
+		}
+	}
+}
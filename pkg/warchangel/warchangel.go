@@ -1,116 +1,402 @@
 package warchangel
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
-	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/remeh/sizedwaitgroup"
 )
 
 var (
-	UploadsInProgress sync.Map
-	S3AccessKey       string
-	S3SecretKey       string
-	logger            *slog.Logger
-	config            *Config
+	// ErrStopped is returned when submitting a file to a stopped Uploader
+	ErrStopped = errors.New("the uploader is stopped")
+	// ErrUnknownFile is returned when submitting a file that isn't a WARC file of one of the jobs
+	ErrUnknownFile = errors.New("not a WARC file of any job")
+	// ErrAlreadyHandled is returned when submitting a file that is being uploaded or was already handled
+	ErrAlreadyHandled = errors.New("already being uploaded or already handled")
+	// ErrInvalidMetadata is returned when submitting a file with metadata keys that IA S3 rejects
+	ErrInvalidMetadata = errors.New("metadata keys must be lowercase letters, digits, - or _")
+	// ErrUploadTimeout is why a file failed when its upload reached the job's upload_timeout or inactivity_timeout
+	ErrUploadTimeout = errors.New("upload timed out")
+)
+
+// Options configures an Uploader
+type Options struct {
+	// Jobs are the configurations of the jobs to run, they must be valid together, see ValidateJobs
+	Jobs []*Config
+	// Logger defaults to discarding the logs
+	Logger *slog.Logger
+	// MaxUploads limits the number of uploads of all the jobs together, 0 means no limit
+	MaxUploads int
+	// ShutdownTimeout is how long Run waits for the uploads in progress once its context
+	// is done before aborting them, 0 means waiting for them to finish
+	ShutdownTimeout time.Duration
+	// S3AccessKey and S3SecretKey are the IA S3 credentials used by the default backend
+	S3AccessKey string
+	S3SecretKey string
+	// Backend sends the files to the Internet Archive, defaults to NewIAS3Backend with the S3 credentials.
+	// NewRcloneBackend can neither create items nor queue their derive: the files of new items, and of
+	// jobs with derive set, fail with it.
+	Backend Backend
+	// OnEvent is called every time a file changes status, from the goroutine handling the file.
+	// It must not block, and must not call the Uploader's methods.
+	OnEvent func(Event)
+	// BandwidthLimit caps the rate of the uploads of all the jobs together, in the syntax of the
+	// jobs' bwlimit. No limit by default.
+	BandwidthLimit string
+	// OnAlert is called when a job runs into a condition that needs the operators' attention,
+	// with the same restrictions as OnEvent
+	OnAlert func(Alert)
+}
+
+// Event is a WARC file changing status. A file whose upload is aborted goes back
+// to queued, with Err set, so that it's uploaded again on the next start. So does a
+// file whose upload archive.org asked to slow down, it's uploaded again once the
+// uploads resume.
+type Event struct {
+	Job    string     `json:"job"`
+	File   string     `json:"file"`
+	Item   string     `json:"item"`
+	Size   int64      `json:"size"`
+	Status FileStatus `json:"status"`
+	// Remote is the path of the uploaded file, set when the file is uploaded
+	Remote string `json:"remote,omitempty"`
+	// Attempt is the number of times the upload of the file was attempted, including this one
+	Attempt int `json:"attempt,omitempty"`
+	// Duration is how long the upload took, set when it ends
+	Duration time.Duration `json:"duration,omitempty"`
+	// Err is why the file failed or why its upload was aborted
+	Err  error     `json:"-"`
+	Time time.Time `json:"time"`
+}
+
+// AlertKind is the condition an Alert is about
+type AlertKind string
+
+const (
+	AlertDiskPressure  AlertKind = "disk_pressure"  // the disk usage reached the job's high-water mark
+	AlertDiskRecovered AlertKind = "disk_recovered" // the disk usage went back under the low-water mark
+	AlertDiskDeletable AlertKind = "disk_deletable" // files uploaded by a job under disk pressure were verified and can be deleted
 )
 
-func NewWatcher(c *Config, l *slog.Logger, uploadThreads int, s3AccessKey, s3SecretKey string, doneChan chan struct{}) error {
+// Alert is a condition of a job that needs the operators' attention
+type Alert struct {
+	Job     string    `json:"job"`
+	Kind    AlertKind `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Stats are the counters of an Uploader since it was created
+type Stats struct {
+	Jobs int `json:"jobs"`
+	// Queued are the files waiting for an upload slot
+	Queued    int64 `json:"queued"`
+	Uploading int64 `json:"uploading"`
+	Uploaded  int64 `json:"uploaded"`
+	Failed    int64 `json:"failed"`
+	// Aborted are the uploads aborted at shutdown. Their files stay queued in the state for the next
+	// start, but like the other files left queued by a stopped job, they don't count in Queued.
+	Aborted       int64 `json:"aborted"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	// DiskPressure are the jobs whose disk usage is above their high-water mark
+	DiskPressure int `json:"disk_pressure"`
+}
+
+// Uploader watches the WARCs directory of its jobs and uploads the WARC files it finds,
+// each job with up to its configured threads in parallel. Several Uploaders can live in
+// the same process as long as they don't share jobs.
+type Uploader struct {
+	logger  *slog.Logger
+	backend Backend
+	onEvent func(Event)
+	onAlert func(Alert)
+	// diskUsage returns the size and free space of the filesystem holding a path
+	diskUsage func(path string) (total, free uint64, err error)
+	// verify compares uploaded files with their copy on archive.org, see Verify
+	verify  func(ctx context.Context, c *Config, l *slog.Logger, store *StateStore, files []string) ([]VerifyResult, error)
+	metrics *metrics
+	// bandwidth caps the rate of the uploads of every job
+	bandwidth *bandwidthLimiter
+	// uploads is the upload budget shared by every job
+	uploads *uploadPool
+	// slowDown pauses the uploads of every job when archive.org asks to slow down
+	slowDown *slowDownBreaker
+	// inProgress holds the *fileProgress of the WARC files queued or being uploaded, by path
+	inProgress sync.Map
+	// uploadCtx is the context of every upload, cancelled by Abort
+	uploadCtx       context.Context
+	abortUploads    context.CancelFunc
+	shutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	running bool
+	stopped bool
+	// jobsWG tracks the running jobs, including the stopped ones still finishing their uploads
+	jobsWG sync.WaitGroup
+
+	statsMu sync.Mutex
+	stats   Stats
+}
+
+// New returns an Uploader for the given jobs, call Run to start it
+func New(opts Options) (*Uploader, error) {
+	if err := ValidateJobs(opts.Jobs); err != nil {
+		return nil, err
+	}
+
+	if _, err := parseBandwidthLimit(opts.BandwidthLimit); err != nil {
+		return nil, fmt.Errorf("invalid bandwidth limit: %w", err)
+	}
+
+	u := newUploader(opts)
+
+	u.mu.Lock()
+	for _, c := range opts.Jobs {
+		u.startJob(c)
+	}
+	u.mu.Unlock()
+
+	return u, nil
+}
+
+// newUploader returns an Uploader without any job
+func newUploader(opts Options) *Uploader {
+	u := &Uploader{
+		logger:          opts.Logger,
+		backend:         opts.Backend,
+		onEvent:         opts.OnEvent,
+		onAlert:         opts.OnAlert,
+		diskUsage:       statDiskUsage,
+		verify:          Verify,
+		uploads:         newUploadPool(opts.MaxUploads),
+		slowDown:        newSlowDownBreaker(),
+		shutdownTimeout: opts.ShutdownTimeout,
+		jobs:            make(map[string]*job),
+	}
+
+	u.uploadCtx, u.abortUploads = context.WithCancel(context.Background())
+	u.metrics = newMetrics(u)
+
+	// Checked by New
+	timetable, _ := parseBandwidthLimit(opts.BandwidthLimit)
+	u.bandwidth = newBandwidthLimiter(timetable)
+
+	if u.logger == nil {
+		u.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	if u.backend == nil {
+		u.backend = newIAS3Backend(opts.S3AccessKey, opts.S3SecretKey)
+	}
+
+	return u
+}
+
+// Run starts the jobs and blocks until ctx is cancelled, then stops the jobs and waits
+// for the uploads in progress to finish, at most ShutdownTimeout after which they are
+// aborted. An Uploader can only run once.
+func (u *Uploader) Run(ctx context.Context) error {
+	u.mu.Lock()
+	if u.running || u.stopped {
+		u.mu.Unlock()
+		return errors.New("the uploader already ran")
+	}
+
+	u.running = true
+	u.logger.Info("starting watcher", "jobs", len(u.jobs), "max-uploads", u.uploads.Size())
+	for _, j := range u.jobs {
+		u.watchJob(j)
+	}
+	u.mu.Unlock()
+
+	<-ctx.Done()
+
+	u.logger.Info("stopping watcher, waiting for uploads to finish")
+
+	u.mu.Lock()
+	for _, j := range u.jobs {
+		j.stop()
+	}
+	u.running = false
+	u.stopped = true
+	u.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		u.jobsWG.Wait()
+		close(finished)
+	}()
+
+	var timeout <-chan time.Time
+	if u.shutdownTimeout > 0 {
+		timer := time.NewTimer(u.shutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-finished:
+		u.logger.Info("all uploads finished, exiting watcher")
+	case <-timeout:
+		u.logger.Warn("shutdown timeout reached, aborting uploads", "timeout", u.shutdownTimeout)
+		u.Abort()
+		<-finished
+		u.logger.Info("uploads aborted, exiting watcher")
+	}
+
+	// Release the context of the uploads
+	u.Abort()
+
+	return nil
+}
+
+// Abort cancels the uploads in progress and the ones that would start, their files are
+// queued again so that they are uploaded on the next start. It's meant to be called
+// during a shutdown, once Run's context is done, so that Run returns promptly.
+func (u *Uploader) Abort() {
+	u.abortUploads()
+}
+
+// Submit queues a WARC file of one of the jobs for upload right away, without waiting for
+// the next scan of the job's WARCs directory nor for the file to be stable: the caller tells
+// the file is closed. metadata is added to the item metadata of the file, it can be nil.
+// Submit returns the item of the file without waiting for the upload, which starts once an
+// upload slot is available. Files can be submitted before Run is called, but not once it returned.
+func (u *Uploader) Submit(path string, metadata ItemMetadata) (item string, err error) {
+	for key := range metadata {
+		if !metadataKeyRegexp.MatchString(key) {
+			return "", fmt.Errorf("invalid metadata key %q: %w", key, ErrInvalidMetadata)
+		}
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	u.mu.Lock()
+	if u.stopped {
+		u.mu.Unlock()
+		return "", ErrStopped
+	}
+
 	var (
-		currentItem     string
-		currentItemSize int64
-		itemCount       = 1
-		wg              = sizedwaitgroup.New(uploadThreads)
+		j    *job
+		name string
 	)
+	for _, candidate := range u.jobs {
+		if rel, ok := candidate.currentConfig().fileName(path); ok {
+			j, name = candidate, rel
+			break
+		}
+	}
+	u.mu.Unlock()
 
-	// Set global variables
-	S3AccessKey = s3AccessKey
-	S3SecretKey = s3SecretKey
-	logger = l
-	config = c
-
-	logger.Info("starting watcher", "path", config.WARCsDir, "interval", config.ScanInterval)
-	ticker := time.NewTicker(time.Duration(config.ScanInterval) * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-doneChan:
-			logger.Info("stopping watcher, waiting for uploads to finish")
-			wg.Wait()
-			logger.Info("all uploads finished, exiting watcher")
-			return nil
-		case <-ticker.C:
-			logger.Debug("watching", "path", config.WARCsDir)
-
-			// Read directory
-			files, err := os.ReadDir(config.WARCsDir)
-			if err != nil {
-				logger.Error("error reading directory", "err", err)
-				continue
-			}
+	if j == nil {
+		return "", fmt.Errorf("%s: %w", path, ErrUnknownFile)
+	}
+
+	return j.submit(name, metadata)
+}
+
+// Stats returns the counters of the Uploader
+func (u *Uploader) Stats() Stats {
+	u.mu.Lock()
+	jobs := len(u.jobs)
+	u.mu.Unlock()
+
+	u.statsMu.Lock()
+	defer u.statsMu.Unlock()
+
+	stats := u.stats
+	stats.Jobs = jobs
 
-			// Iterate over files
-			for _, file := range files {
-				if file.IsDir() {
-					continue
-				}
-
-				name := file.Name()
-
-				// Check if it's a WARC file
-				if !(strings.HasSuffix(name, ".warc.zst") || strings.HasSuffix(name, ".warc.gz")) {
-					continue
-				}
-
-				// Check if already uploading
-				if _, ok := UploadsInProgress.Load(name); ok {
-					continue
-				}
-
-				// Init the item name if it's the first upload
-				if currentItem == "" {
-					currentItem, err = getItemName(name)
-					if err != nil {
-						panic(err)
-					}
-				}
-
-				// Get file size
-				fullPath := filepath.Join(config.WARCsDir, name)
-				info, err := os.Stat(fullPath)
-				if err != nil {
-					logger.Error("unable to stat file", "file", name, "err", err)
-					continue
-				}
-
-				size := info.Size()
-
-				// Check if adding this file exceeds the current item size limit
-				if currentItemSize+size > int64(config.ItemSize*1024) {
-					// finalize current item (in real logic, you might have to mark item completed)
-					logger.Info("item size limit reached, starting new item")
-
-					itemCount++
-					currentItem, err = getItemName(name)
-					if err != nil {
-						panic(err)
-					}
-
-					currentItemSize = 0
-				}
-
-				// Add this file to current item and start uploading
-				currentItemSize += size
-
-				// Start upload
-				wg.Add()
-				go uploadFile(name, currentItem, &wg)
+	return stats
+}
+
+// emit updates the counters with the new status of a file and sends the event to the callback
+func (u *Uploader) emit(e Event) {
+	e.Time = time.Now()
+
+	u.statsMu.Lock()
+	switch e.Status {
+	case FileQueued:
+		if e.Err != nil {
+			u.stats.Uploading--
+			if errorClass(e.Err) == errorClassAborted {
+				u.stats.Aborted++
+				break
 			}
 		}
+		u.stats.Queued++
+	case FileUploading:
+		u.stats.Queued--
+		u.stats.Uploading++
+	case FileUploaded:
+		u.stats.Uploading--
+		u.stats.Uploaded++
+		u.stats.UploadedBytes += e.Size
+	case FileFailed:
+		u.stats.Uploading--
+		u.stats.Failed++
+	}
+	u.statsMu.Unlock()
+
+	u.metrics.observe(e)
+
+	if u.onEvent != nil {
+		u.onEvent(e)
 	}
 }
+
+// alert sends the alert to the callback
+func (u *Uploader) alert(a Alert) {
+	a.Time = time.Now()
+
+	if u.onAlert != nil {
+		u.onAlert(a)
+	}
+}
+
+// diskPressure updates the number of jobs under disk pressure
+func (u *Uploader) diskPressure(delta int) {
+	u.statsMu.Lock()
+	defer u.statsMu.Unlock()
+
+	u.stats.DiskPressure += delta
+}
+
+// dequeue removes files of a job that were queued but didn't start from the counters
+func (u *Uploader) dequeue(job string, files int) {
+	u.metrics.queued.WithLabelValues(job).Sub(float64(files))
+
+	u.statsMu.Lock()
+	defer u.statsMu.Unlock()
+
+	u.stats.Queued -= int64(files)
+}
+
+// startJob adds a job, and starts watching it if the Uploader is running. u.mu must be held.
+func (u *Uploader) startJob(c *Config) {
+	j := u.newJob(c, NewStateStore(DefaultStatePath(c)))
+	u.jobs[c.Job] = j
+
+	if u.running {
+		u.watchJob(j)
+	}
+}
+
+// watchJob starts watching a job, u.mu must be held
+func (u *Uploader) watchJob(j *job) {
+	u.jobsWG.Add(1)
+	go func() {
+		defer u.jobsWG.Done()
+		j.watch()
+	}()
+}
@@ -0,0 +1,294 @@
+package warchangel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploaderSubmit(t *testing.T) {
+	c := testJobConfig(t, "test")
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 600,
+		"WEB-20240109170700000-00002-endgame.local.warc.gz": 400,
+	})
+
+	var (
+		mu       sync.Mutex
+		events   []Event
+		uploaded = make(chan struct{}, 1)
+	)
+
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	u, err := New(Options{
+		Jobs:    []*Config{c},
+		Logger:  l,
+		Backend: &dryRunBackend{logger: l},
+		OnEvent: func(e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+			if e.Status == FileUploaded {
+				uploaded <- struct{}{}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := filepath.Join(c.WARCsDir, "WEB-20240109170659538-00001-endgame.local.warc.gz")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	item, err := u.Submit(first, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != "WEB-20240109170659-endgame" {
+		t.Errorf("unexpected item %s", item)
+	}
+	if _, err := u.Submit(first, nil); !errors.Is(err, ErrAlreadyHandled) {
+		t.Errorf("expected submitting a file twice to fail, got %v", err)
+	}
+	if _, err := u.Submit(filepath.Join(t.TempDir(), "WEB-20240109170700000-00002-endgame.local.warc.gz"), nil); !errors.Is(err, ErrUnknownFile) {
+		t.Errorf("expected submitting a file outside of the jobs' WARCs directories to fail, got %v", err)
+	}
+
+	select {
+	case <-uploaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the submitted file to be uploaded")
+	}
+
+	cancel()
+	<-stopped
+
+	if _, err := u.Submit(first, nil); !errors.Is(err, ErrStopped) {
+		t.Errorf("expected submitting to a stopped uploader to fail, got %v", err)
+	}
+
+	expected := []FileStatus{FileQueued, FileUploading, FileUploaded}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, e := range events {
+		if e.Status != expected[i] || e.Job != "test" || e.Item != "WEB-20240109170659-endgame" || e.Size != 600 {
+			t.Errorf("unexpected event %d: %+v", i, e)
+		}
+	}
+
+	stats := u.Stats()
+	if stats != (Stats{Jobs: 1, Uploaded: 1, UploadedBytes: 600}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	st, err := NewStateStore(DefaultStatePath(c)).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := st.Files[filepath.Base(first)]; f == nil || f.Status != FileUploaded {
+		t.Errorf("expected the submitted file to be recorded as uploaded, got %+v", f)
+	}
+}
+
+// blockingBackend blocks uploads until their context is done
+type blockingBackend struct {
+	started chan string
+}
+
+func (b *blockingBackend) Put(ctx context.Context, upload *Upload) (string, error) {
+	b.started <- upload.Filename
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestUploaderShutdownTimeout(t *testing.T) {
+	c := testJobConfig(t, "test")
+	c.Threads = 1
+	writeWARCs(t, c.WARCsDir, map[string]int{
+		"WEB-20240109170659538-00001-endgame.local.warc.gz": 600,
+		"WEB-20240109170659538-00002-endgame.local.warc.gz": 600,
+	})
+
+	backend := &blockingBackend{started: make(chan string, 1)}
+	u, err := New(Options{
+		Jobs:            []*Config{c},
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backend:         backend,
+		ShutdownTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := u.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	name := "WEB-20240109170659538-00001-endgame.local.warc.gz"
+	if _, err := u.Submit(filepath.Join(c.WARCsDir, name), nil); err != nil {
+		t.Fatal(err)
+	}
+	<-backend.started
+
+	// The second file waits for the only upload slot
+	if _, err := u.Submit(filepath.Join(c.WARCsDir, "WEB-20240109170659538-00002-endgame.local.warc.gz"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if stats := u.Stats(); stats != (Stats{Jobs: 1, Queued: 1, Uploading: 1}) {
+		t.Errorf("unexpected stats before the shutdown %+v", stats)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the upload to be aborted after the shutdown timeout")
+	}
+
+	// Like the file left waiting, the aborted file stays queued in the state but leaves the counters
+	if stats := u.Stats(); stats != (Stats{Jobs: 1, Aborted: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	st, err := NewStateStore(DefaultStatePath(c)).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := st.Files[name]; f == nil || f.Status != FileQueued || f.Error == "" || f.Attempts != 1 {
+		t.Errorf("expected the aborted file to be queued again with its error, got %+v", f)
+	}
+}
+
+// metadataBackend is a recordingBackend able to add metadata to existing items
+type metadataBackend struct {
+	*recordingBackend
+	updates map[string][]ItemMetadata
+}
+
+func (b *metadataBackend) UpdateMetadata(ctx context.Context, item string, metadata ItemMetadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updates[item] = append(b.updates[item], metadata)
+
+	return nil
+}
+
+func TestUploaderSubmitExistingItemMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend Backend
+		status  FileStatus
+	}{
+		{
+			name:    "metadata backend",
+			backend: &metadataBackend{recordingBackend: newRecordingBackend(), updates: make(map[string][]ItemMetadata)},
+			status:  FileUploaded,
+		},
+		{
+			name:    "backend without metadata updates",
+			backend: newRecordingBackend(),
+			status:  FileFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testJobConfig(t, "test")
+			// Scans must leave the files alone, only the submitted ones are uploaded
+			c.StabilityWait = 3600
+			writeWARCs(t, c.WARCsDir, map[string]int{
+				"WEB-20240109170659538-00001-endgame.local.warc.gz": 600,
+				"WEB-20240109170700000-00002-endgame.local.warc.gz": 400,
+			})
+
+			done := make(chan Event, 2)
+			u, err := New(Options{
+				Jobs:    []*Config{c},
+				Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Backend: tt.backend,
+				OnEvent: func(e Event) {
+					if e.Status == FileUploaded || e.Status == FileFailed {
+						done <- e
+					}
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				if err := u.Run(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+			defer func() {
+				cancel()
+				<-stopped
+			}()
+
+			wait := func() Event {
+				t.Helper()
+				select {
+				case e := <-done:
+					return e
+				case <-time.After(5 * time.Second):
+					t.Fatal("expected the submitted file to be handled")
+					return Event{}
+				}
+			}
+
+			// The first file creates the item, with the submitted metadata in its headers
+			first := filepath.Join(c.WARCsDir, "WEB-20240109170659538-00001-endgame.local.warc.gz")
+			if _, err := u.Submit(first, ItemMetadata{"subject": {"a"}}); err != nil {
+				t.Fatal(err)
+			}
+			if e := wait(); e.Status != FileUploaded {
+				t.Fatalf("expected the file creating the item to be uploaded, got %+v", e)
+			}
+
+			second := filepath.Join(c.WARCsDir, "WEB-20240109170700000-00002-endgame.local.warc.gz")
+			item, err := u.Submit(second, ItemMetadata{"subject": {"b"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := wait()
+			if e.Status != tt.status {
+				t.Fatalf("expected the file of the existing item to be %s, got %+v", tt.status, e)
+			}
+			if e.Status == FileFailed && errorClass(e.Err) != errorClassMetadata {
+				t.Errorf("expected a metadata error, got %v", e.Err)
+			}
+
+			if b, ok := tt.backend.(*metadataBackend); ok {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				updates := b.updates[item]
+				if len(updates) != 1 || len(updates[0]["subject"]) != 1 || updates[0]["subject"][0] != "b" {
+					t.Errorf("expected only the metadata submitted for the existing item to be updated, got %v", b.updates)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// planCommand shows how the WARC files waiting to be uploaded would be grouped into items, for each job
+func planCommand() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+
+	reports := make(map[string]any)
+	for _, config := range configs {
+		state, err := warchangel.NewStateStore(warchangel.DefaultStatePath(config)).Load()
+		if err != nil {
+			return err
+		}
+
+		items, err := warchangel.Plan(config, logger, state)
+		if err != nil {
+			return err
+		}
+
+		reports[config.Job] = items
+	}
+
+	return printJobsJSON(configs, reports)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// retryCommand requeues the failed files of each job, the running instance picks them up on its next scan
+func retryCommand() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+
+	reports := make(map[string]any)
+	for _, config := range configs {
+		requeued, err := warchangel.NewStateStore(warchangel.DefaultStatePath(config)).Requeue(arguments.Files)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("requeued failed files", "job", config.Job, "count", len(requeued))
+
+		reports[config.Job] = requeued
+	}
+
+	return printJobsJSON(configs, reports)
+}
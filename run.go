@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// configWatchInterval is how often the configuration file is checked for changes with --watch-config
+const configWatchInterval = 5 * time.Second
+
+// runCommand starts the watcher and uploads WARC files until a termination signal is received
+func runCommand() error {
+	logger.Info("starting warchangel")
+	logger.Debug("config",
+		"threads", arguments.Threads,
+		"max-uploads", arguments.MaxUploads,
+		"bwlimit", arguments.BandwidthLimit,
+		"shutdown-timeout", arguments.ShutdownTimeout,
+		"s3-access-key", arguments.S3AccessKey,
+		"s3-secret-key", arguments.S3SecretKey,
+		"s3-creds-file", arguments.S3CredsFile,
+		"config", arguments.Config,
+		"debug", arguments.Debug,
+		"dry-run", arguments.DryRun,
+		"watch-config", arguments.WatchConfig,
+		"listen", arguments.Listen,
+		"status-listen", arguments.StatusListen,
+	)
+
+	configs, err := loadJobs()
+	if err != nil {
+		return err
+	}
+
+	if arguments.DryRun {
+		var reports []*warchangel.DryRunReport
+		for _, config := range configs {
+			report, err := warchangel.DryRun(config, logger)
+			if err != nil {
+				return err
+			}
+
+			reports = append(reports, report)
+		}
+
+		return printJSON(reports)
+	}
+
+	uploader, err := warchangel.New(warchangel.Options{
+		Jobs:            configs,
+		Logger:          logger,
+		MaxUploads:      arguments.MaxUploads,
+		BandwidthLimit:  arguments.BandwidthLimit,
+		ShutdownTimeout: time.Duration(arguments.ShutdownTimeout) * time.Second,
+		S3AccessKey:     arguments.S3AccessKey,
+		S3SecretKey:     arguments.S3SecretKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Start the watcher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- uploader.Run(ctx)
+	}()
+
+	for _, api := range []struct {
+		name    string
+		addr    string
+		handler http.Handler
+	}{
+		{"push API", arguments.Listen, uploader.SubmitHandler()},
+		{"status API", arguments.StatusListen, uploader.StatusHandler()},
+	} {
+		if api.addr == "" {
+			continue
+		}
+
+		server, err := serveAPI(api.name, api.addr, api.handler)
+		if err != nil {
+			cancel()
+			<-runErr
+			return err
+		}
+		defer server.Close()
+	}
+
+	// Set up signal handling, SIGHUP reloads the configuration
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	var (
+		watchChan <-chan time.Time
+		modTime   = configModTime()
+	)
+	if arguments.WatchConfig {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		watchChan = ticker.C
+	}
+
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				logger.Info("received signal, reloading configuration", "signal", sig)
+				reloadConfig(uploader)
+				continue
+			}
+
+			logger.Info("received signal, shutting down, send it again to abort the uploads in progress", "signal", sig)
+			cancel()
+
+			return waitShutdown(uploader, sigChan, runErr)
+		case <-watchChan:
+			if current := configModTime(); !current.Equal(modTime) {
+				modTime = current
+				logger.Info("configuration file changed, reloading configuration", "config", arguments.Config)
+				reloadConfig(uploader)
+			}
+		}
+	}
+}
+
+// serveAPI serves an API of the uploader on addr in the background, the push API on the --listen
+// address and the metrics and status on the --status-listen one
+func serveAPI(name, addr string, handler http.Handler) (*http.Server, error) {
+	listener, err := warchangel.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(name+" stopped", "err", err)
+		}
+	}()
+
+	logger.Info(name+" listening", "addr", addr)
+
+	return server, nil
+}
+
+// waitShutdown waits for the uploader to stop, aborting the uploads
+// in progress if another termination signal is received meanwhile
+func waitShutdown(uploader *warchangel.Uploader, sigChan chan os.Signal, runErr chan error) error {
+	for {
+		select {
+		case err := <-runErr:
+			return err
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				continue
+			}
+
+			logger.Warn("received second signal, aborting uploads", "signal", sig)
+			uploader.Abort()
+		}
+	}
+}
+
+// loadJobs loads the jobs' configurations and applies the run command's overrides
+func loadJobs() ([]*warchangel.Config, error) {
+	configs, err := warchangel.LoadJobs(arguments.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, config := range configs {
+		if arguments.Threads > 0 {
+			config.Threads = arguments.Threads
+		}
+	}
+
+	logger.Info("loaded jobs", "config", arguments.Config, "jobs", len(configs))
+
+	return configs, nil
+}
+
+// reloadConfig loads the jobs' configurations again and hands them to the watcher,
+// the running configuration is kept if the new one is invalid, and the jobs whose
+// new configuration is unsafe to apply keep theirs
+func reloadConfig(uploader *warchangel.Uploader) {
+	configs, err := loadJobs()
+	if err != nil {
+		logger.Error("unable to reload configuration, keeping the running configuration", "err", err)
+		return
+	}
+
+	if err := uploader.Reload(configs); err != nil {
+		logger.Error("unable to reload configuration of some jobs, they keep their running configuration", "err", err)
+		return
+	}
+
+	logger.Info("configuration reloaded")
+}
+
+// configModTime returns the latest modification time of the configuration file, or of
+// the directory of configurations and its files, or the zero time if it can't be read
+func configModTime() time.Time {
+	info, err := os.Stat(arguments.Config)
+	if err != nil {
+		return time.Time{}
+	}
+
+	modTime := info.ModTime()
+	if !info.IsDir() {
+		return modTime
+	}
+
+	entries, err := os.ReadDir(arguments.Config)
+	if err != nil {
+		return modTime
+	}
+
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime
+}
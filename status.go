@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// statusCommand shows an overview of the state of each job
+func statusCommand() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+
+	reports := make(map[string]any)
+	for _, config := range configs {
+		state, err := warchangel.NewStateStore(warchangel.DefaultStatePath(config)).Load()
+		if err != nil {
+			return err
+		}
+
+		reports[config.Job] = state.Summary()
+	}
+
+	return printJobsJSON(configs, reports)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// validateConfigCommand loads and validates the configuration of every job, reporting every
+// problem found along with the effective configurations once defaults are applied
+func validateConfigCommand() error {
+	var report struct {
+		Valid    bool                    `json:"valid"`
+		Problems []warchangel.FieldError `json:"problems,omitempty"`
+		Config   *warchangel.Config      `json:"config,omitempty"`
+		Jobs     []*warchangel.Config    `json:"jobs,omitempty"`
+	}
+
+	configs, err := loadConfigs()
+
+	var validationErr *warchangel.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		report.Problems = validationErr.Problems
+	case err != nil:
+		return err
+	default:
+		if len(configs) == 1 {
+			report.Config = configs[0]
+		} else {
+			report.Jobs = configs
+		}
+
+		for _, config := range configs {
+			field := "warcs"
+			if len(configs) > 1 {
+				field = config.Job + ".warcs"
+			}
+
+			// The WARCs directory is only checked here as it may not exist yet when the daemon starts
+			if info, err := os.Stat(config.WARCsDir); err != nil {
+				report.Problems = append(report.Problems, warchangel.FieldError{Field: field, Message: err.Error()})
+			} else if !info.IsDir() {
+				report.Problems = append(report.Problems, warchangel.FieldError{Field: field, Message: "is not a directory"})
+			}
+		}
+	}
+
+	report.Valid = len(report.Problems) == 0
+
+	if err := printJSON(report); err != nil {
+		return err
+	}
+
+	if !report.Valid {
+		return fmt.Errorf("configuration has %d problems", len(report.Problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/internetarchive/warchangel/pkg/warchangel"
+)
+
+// verifyCommand compares the uploaded files of each job with their copy on archive.org
+func verifyCommand() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+
+	var (
+		reports  = make(map[string]any)
+		mismatch bool
+	)
+	for _, config := range configs {
+		store := warchangel.NewStateStore(warchangel.DefaultStatePath(config))
+
+		results, err := warchangel.Verify(context.Background(), config, logger, store, arguments.Files)
+		if err != nil {
+			return fmt.Errorf("%s: %w", config.Job, err)
+		}
+
+		for _, result := range results {
+			mismatch = mismatch || result.Mismatch
+		}
+
+		reports[config.Job] = results
+	}
+
+	if err := printJobsJSON(configs, reports); err != nil {
+		return err
+	}
+
+	if mismatch {
+		return fmt.Errorf("some files differ from their uploaded copy")
+	}
+
+	return nil
+}